@@ -1,41 +1,259 @@
 package queuerunner
 
-import "time"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 func WithErrorHandler(action Action, handler ErrorHandler) Action {
-	return func(ctx *Context) error {
+	return wrapAction(action, func(ctx *Context) error {
 		err := action(ctx)
 		if err != nil && handler != nil {
 			handler(err, ctx)
 			return nil
 		}
 		return err
-	}
+	}, nil)
 }
 
 func WithDelay(action Action, delay time.Duration) Action {
-	return func(ctx *Context) error {
+	return wrapAction(action, func(ctx *Context) error {
 		if err := action(ctx); err != nil {
 			return err
 		}
-		if delay > 0 {
-			time.Sleep(delay)
-		}
+		ctx.sleep(delay)
 		return nil
-	}
+	}, nil)
 }
 
 func WithLock(scope string, action Action) Action {
+	return lockedAction(scope, action, func(locking LockingContext) bool {
+		return locking.IsLocked(scope)
+	}, func(ctx context.Context, locking LockingContext, fn func() error) error {
+		return runWithLockContext(ctx, locking, scope, fn)
+	})
+}
+
+// WithRLock runs the action holding a shared hold on scope: readers of the
+// same scope run together while WithLock holders wait for them to finish.
+// Once a writer is waiting, new readers queue behind it.
+func WithRLock(scope string, action Action) Action {
+	return lockedAction(scope, action, func(locking LockingContext) bool {
+		if shared, ok := locking.(SharedLockingContext); ok {
+			return shared.RLockBlocked(scope)
+		}
+		return locking.IsLocked(scope)
+	}, func(ctx context.Context, locking LockingContext, fn func() error) error {
+		if shared, ok := locking.(sharedContextLocking); ok {
+			return shared.RunWithRLockContext(ctx, scope, fn)
+		}
+		if shared, ok := locking.(SharedLockingContext); ok {
+			return shared.RunWithRLock(scope, fn)
+		}
+		return runWithLockContext(ctx, locking, scope, fn)
+	})
+}
+
+// WithSemaphore runs the action holding one of capacity slots of scope, so
+// up to capacity actions across queues use the scope at once.
+func WithSemaphore(scope string, capacity int, action Action) Action {
+	if capacity <= 0 {
+		return func(_ *Context) error { return ErrInvalidCapacity }
+	}
+
+	return lockedAction(scope, action, func(locking LockingContext) bool {
+		if semaphore, ok := locking.(SemaphoreLockingContext); ok {
+			return semaphore.SemaphoreBlocked(scope, capacity)
+		}
+		return locking.IsLocked(scope)
+	}, func(ctx context.Context, locking LockingContext, fn func() error) error {
+		if semaphore, ok := locking.(SemaphoreLockingContext); ok {
+			return semaphore.RunWithSemaphore(ctx, scope, capacity, fn)
+		}
+		return runWithLockContext(ctx, locking, scope, fn)
+	})
+}
+
+// WithLocks runs the action holding every scope exclusively. The scopes are
+// taken all at once, and none is held while waiting for the others, so
+// actions naming the same scopes in different orders cannot deadlock.
+func WithLocks(scopes []string, action Action) Action {
+	canonical, err := canonicalScopes(scopes)
+	if err != nil {
+		return func(_ *Context) error { return err }
+	}
+
+	return scopedAction(canonical, action, func(locking LockingContext) bool {
+		for _, scope := range canonical {
+			if locking.IsLocked(scope) {
+				return true
+			}
+		}
+		return false
+	}, func(ctx context.Context, locking LockingContext, fn func() error) error {
+		return runWithLocks(ctx, locking, canonical, fn)
+	})
+}
+
+// WithLockTimeout is WithLock that gives up after waiting timeout for the
+// scope and fails with a *LockTimeoutError instead of running the action.
+func WithLockTimeout(scope string, timeout time.Duration, action Action) Action {
+	return lockedAction(scope, action, func(locking LockingContext) bool {
+		return locking.IsLocked(scope)
+	}, func(ctx context.Context, locking LockingContext, fn func() error) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		acquired := false
+		err := runWithLockContext(ctx, locking, scope, func() error {
+			acquired = true
+			return fn()
+		})
+		if !acquired && errors.Is(err, context.DeadlineExceeded) {
+			return &LockTimeoutError{Scope: scope, Timeout: timeout}
+		}
+		return err
+	})
+}
+
+// WithLockPriority is WithLock whose wait for the scope is served before
+// lower-priority waiters. Priorities only apply to locking contexts with
+// FIFO handoff, such as the default LockManager.
+func WithLockPriority(scope string, priority int, action Action) Action {
+	return lockedAction(scope, action, func(locking LockingContext) bool {
+		return locking.IsLocked(scope)
+	}, func(ctx context.Context, locking LockingContext, fn func() error) error {
+		return runWithLockContext(ContextWithLockPriority(ctx, priority), locking, scope, fn)
+	})
+}
+
+// WithLease is WithLock whose hold expires unless the action renews it
+// with ctx.RenewLock at least every ttl. On expiry the scope is released for
+// others, ctx.Context() is cancelled and the action fails with a
+// *LeaseExpiredError once it returns. ctx.FencingToken identifies the lease
+// to downstream code.
+func WithLease(scope string, ttl time.Duration, action Action) Action {
+	if ttl <= 0 {
+		return func(_ *Context) error { return ErrInvalidTTL }
+	}
+
+	return lockedAction(scope, action, func(locking LockingContext) bool {
+		return locking.IsLocked(scope)
+	}, func(ctx context.Context, locking LockingContext, fn func() error) error {
+		queueCtx := queueContextOf(ctx)
+		leasing, ok := locking.(LeaseLockingContext)
+		if !ok {
+			return runWithLockContext(ctx, locking, scope, func() error {
+				defer queueCtx.enterLease(scope, nil)()
+				return fn()
+			})
+		}
+
+		err := leasing.RunWithLease(ctx, scope, ttl, func(lease *Lease) error {
+			defer queueCtx.enterLease(scope, lease)()
+			return fn()
+		})
+		var expired *LeaseExpiredError
+		if errors.As(err, &expired) {
+			queueCtx.emit(func(info EventInfo) Event {
+				return LockExpired{EventInfo: info, Scope: scope, Token: expired.Token}
+			})
+		}
+		return err
+	})
+}
+
+type sharedContextLocking interface {
+	RunWithRLockContext(ctx context.Context, scope string, fn func() error) error
+}
+
+const lockPollInterval = 10 * time.Millisecond
+
+// runWithLockContext takes scope exclusively, passing ctx on to locking
+// contexts that understand it. Others get a plain RunWithLock unless ctx can
+// be cancelled, in which case Lock is polled until ctx is done.
+func runWithLockContext(ctx context.Context, locking LockingContext, scope string, fn func() error) error {
+	if cancellable, ok := locking.(ContextLockingContext); ok {
+		return cancellable.RunWithLockContext(ctx, scope, fn)
+	}
+	if ctx.Done() == nil {
+		return locking.RunWithLock(scope, fn)
+	}
+
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for locking.Lock(scope) != nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer locking.Unlock(scope)
+
+	return fn()
+}
+
+func lockedAction(scope string, action Action, blocked func(LockingContext) bool, run func(context.Context, LockingContext, func() error) error) Action {
 	if err := ValidateScope(scope); err != nil {
 		return func(_ *Context) error { return err }
 	}
+	return scopedAction([]string{scope}, action, blocked, run)
+}
+
+// scopedAction wraps action so that run holds the scopes around it,
+// reporting waits, acquisition, release and deadlocks of the scopes as
+// events. run gets a context carrying the queue's lock owner.
+func scopedAction(scopes []string, action Action, blocked func(LockingContext) bool, run func(context.Context, LockingContext, func() error) error) Action {
+	emit := func(ctx *Context, event func(info EventInfo, scope string) Event) {
+		for _, scope := range scopes {
+			ctx.emit(func(info EventInfo) Event { return event(info, scope) })
+		}
+	}
 
-	return func(ctx *Context) error {
+	return wrapAction(action, func(ctx *Context) error {
 		if ctx == nil || ctx.locking == nil {
 			return action(ctx)
 		}
-		return ctx.locking.RunWithLock(scope, func() error {
+		if blocked(ctx.locking) {
+			emit(ctx, func(info EventInfo, scope string) Event {
+				return LockWaiting{EventInfo: info, Scope: scope}
+			})
+		}
+
+		acquired := false
+		defer func() {
+			if acquired {
+				emit(ctx, func(info EventInfo, scope string) Event {
+					return LockReleased{EventInfo: info, Scope: scope}
+				})
+			}
+		}()
+
+		// With a worker pool the queue gives up its worker while it waits
+		// for the scopes, keeping its goroutine, and takes one back before
+		// the action runs.
+		lockCtx, rejoin := ctx.waitingLockContext(ctx.locking)
+		defer rejoin()
+
+		err := run(lockCtx, ctx.locking, func() error {
+			rejoin()
+			acquired = true
+			emit(ctx, func(info EventInfo, scope string) Event {
+				return LockAcquired{EventInfo: info, Scope: scope}
+			})
+			ctx.locked++
+			defer func() { ctx.locked-- }()
 			return action(ctx)
 		})
-	}
+
+		var deadlock *DeadlockError
+		if !acquired && errors.As(err, &deadlock) {
+			ctx.emit(func(info EventInfo) Event {
+				return LockDeadlock{EventInfo: info, Scopes: deadlock.Scopes, Cycle: deadlock.Cycle}
+			})
+		}
+		return err
+	}, nil)
 }
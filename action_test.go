@@ -1,6 +1,9 @@
 package queuerunner
 
 import (
+	"errors"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -42,3 +45,111 @@ func TestWithLockInvalidScopeReturnsError(t *testing.T) {
 		t.Fatal("expected error for invalid lock scope")
 	}
 }
+
+type exclusiveOnly struct {
+	LockingContext
+}
+
+func TestWithRLockFallsBackToExclusive(t *testing.T) {
+	manager := NewLockManager()
+	locking := exclusiveOnly{manager}
+	if _, ok := LockingContext(locking).(SharedLockingContext); ok {
+		t.Fatal("expected test locking context to lack shared holds")
+	}
+
+	var exclusive bool
+	action := WithRLock("db", func(_ *Context) error {
+		exclusive = manager.RLockBlocked("db")
+		return nil
+	})
+
+	if err := action(&Context{locking: locking}); err != nil || !exclusive {
+		t.Fatal("expected WithRLock to take an exclusive hold on a plain LockingContext")
+	}
+}
+
+func TestWithSemaphoreLimitsConcurrentActions(t *testing.T) {
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}})
+	var inside, peak int32
+
+	action := WithSemaphore("browser", 2, func(_ *Context) error {
+		current := atomic.AddInt32(&inside, 1)
+		for {
+			seen := atomic.LoadInt32(&peak)
+			if current <= seen || atomic.CompareAndSwapInt32(&peak, seen, current) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&inside, -1)
+		return nil
+	})
+	for index := 0; index < 6; index++ {
+		runner.Add([]Action{action}, map[string]any{}, "")
+	}
+	waitIdle(t, runner)
+
+	if got := atomic.LoadInt32(&peak); got != 2 {
+		t.Fatalf("expected 2 concurrent holders, got %d", got)
+	}
+	if err := WithSemaphore("browser", 0, action)(&Context{}); !errors.Is(err, ErrInvalidCapacity) {
+		t.Fatalf("expected ErrInvalidCapacity, got %v", err)
+	}
+}
+
+func TestWithLockTimeoutReturnsLockTimeoutError(t *testing.T) {
+	manager := NewLockManager()
+	if err := manager.Lock("db"); err != nil {
+		t.Fatal(err)
+	}
+
+	ran := false
+	action := WithLockTimeout("db", 10*time.Millisecond, func(_ *Context) error {
+		ran = true
+		return nil
+	})
+
+	for _, locking := range []LockingContext{manager, exclusiveOnly{manager}} {
+		err := action(&Context{locking: locking})
+		var timeout *LockTimeoutError
+		if !errors.Is(err, ErrLockTimeout) || !errors.As(err, &timeout) || timeout.Scope != "db" || ran {
+			t.Fatalf("expected lock timeout, got %v", err)
+		}
+	}
+
+	manager.Unlock("db")
+	if err := action(&Context{locking: exclusiveOnly{manager}}); err != nil || !ran {
+		t.Fatalf("expected action to run once the scope is free, got %v", err)
+	}
+	if manager.IsLocked("db") {
+		t.Fatal("expected scope to be released")
+	}
+}
+
+func TestWithLockPriorityRunsBeforeLowerPriorityWaiters(t *testing.T) {
+	manager := NewLockManager()
+	if err := manager.Lock("db"); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &orderRecorder{}
+	record := func(name string) Action {
+		return func(_ *Context) error { return recorder.record(name)() }
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = WithLock("db", record("normal"))(&Context{locking: manager})
+	}()
+	waitQueued(t, manager, "db", 1)
+	go func() {
+		defer wg.Done()
+		_ = WithLockPriority("db", 1, record("urgent"))(&Context{locking: manager})
+	}()
+	waitQueued(t, manager, "db", 2)
+
+	manager.Unlock("db")
+	wg.Wait()
+	recorder.expect(t, "urgent", "normal")
+}
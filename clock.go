@@ -0,0 +1,22 @@
+package queuerunner
+
+import "time"
+
+type Timer interface {
+	Stop() bool
+}
+
+type Clock interface {
+	Now() time.Time
+	AfterFunc(delay time.Duration, fn func()) Timer
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(delay time.Duration, fn func()) Timer {
+	return time.AfterFunc(delay, fn)
+}
@@ -0,0 +1,68 @@
+package queuerunner
+
+import "fmt"
+
+type CompensationResult struct {
+	Action string
+	Err    error
+}
+
+// compensation is one WithCompensation's undo action. It is registered by
+// pointer, so an action that runs again after Restart or GoTo does not
+// register its compensation twice.
+type compensation struct {
+	action Action
+}
+
+// WithCompensation registers compensate once action succeeds. When the
+// queue ends with an error, whether it stopped early or the error handler
+// let it continue, or when it was aborted, the registered compensations run
+// newest first.
+func WithCompensation(action Action, compensate Action) Action {
+	undo := &compensation{action: compensate}
+	return wrapAction(action, func(ctx *Context) error {
+		if err := action(ctx); err != nil {
+			return err
+		}
+		if ctx != nil && ctx.compensateFn != nil && compensate != nil {
+			ctx.compensateFn(undo)
+		}
+		return nil
+	}, nil)
+}
+
+// addCompensation registers undo as the newest compensation, moving it
+// there if an earlier run of its action registered it already.
+func (queue *Queue) addCompensation(undo *compensation) {
+	for index, registered := range queue.undo {
+		if registered == undo {
+			queue.undo = append(queue.undo[:index], queue.undo[index+1:]...)
+			break
+		}
+	}
+	queue.undo = append(queue.undo, undo)
+}
+
+// compensate runs the registered compensations newest first. A failing
+// compensation is recorded and does not stop the ones registered before it.
+func (queue *Queue) compensate() []CompensationResult {
+	results := make([]CompensationResult, 0, len(queue.undo))
+
+	for len(queue.undo) > 0 {
+		last := len(queue.undo) - 1
+		action := queue.undo[last].action
+		queue.undo = queue.undo[:last]
+
+		name := actionName(action)
+		queue.logger.SetContext(name)
+		queue.logger.Info(fmt.Sprintf("Queue(%s): compensating", queue.name))
+
+		_, err := queue.executeSafe(action)
+		if err != nil {
+			queue.logger.Error(err)
+		}
+		results = append(results, CompensationResult{Action: name, Err: err})
+	}
+
+	return results
+}
@@ -0,0 +1,155 @@
+package queuerunner
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCompensationsRunInReverseOnFailure(t *testing.T) {
+	order := []string{}
+	step := func(name string, undoErr error) Action {
+		return WithCompensation(func(_ *Context) error {
+			order = append(order, name)
+			return nil
+		}, func(_ *Context) error {
+			order = append(order, "undo-"+name)
+			return undoErr
+		})
+	}
+
+	undoFailure := errors.New("refund failed")
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			step("create", nil),
+			step("charge", undoFailure),
+			anyAction(func(_ *Context) error { return ErrInvalidScope }),
+			step("notify", nil),
+		},
+		Name:   "TestQueue",
+		Logger: &testLogger{},
+	})
+
+	result := queue.Run(map[string]any{})
+
+	expected := []string{"create", "charge", "undo-charge", "undo-create"}
+	if len(order) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, order)
+		}
+	}
+
+	if !errors.Is(result.Err, ErrInvalidScope) || !result.Aborted {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if len(result.Compensations) != 2 {
+		t.Fatalf("expected 2 compensations, got %+v", result.Compensations)
+	}
+	if !errors.Is(result.Compensations[0].Err, undoFailure) || result.Compensations[1].Err != nil {
+		t.Fatalf("unexpected compensation results: %+v", result.Compensations)
+	}
+}
+
+func TestCompensationsRunOnAbort(t *testing.T) {
+	undone := 0
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			WithCompensation(func(_ *Context) error { return nil }, func(_ *Context) error {
+				undone++
+				return nil
+			}),
+			Util.Abort,
+		},
+		Name:   "TestQueue",
+		Logger: &testLogger{},
+	})
+
+	result := queue.Run(map[string]any{})
+
+	if undone != 1 || len(result.Compensations) != 1 {
+		t.Fatalf("expected compensation on abort, got %d runs and %+v", undone, result)
+	}
+}
+
+func TestCompensationsSkippedOnSuccess(t *testing.T) {
+	undone := 0
+	failing := WithCompensation(func(_ *Context) error { return ErrInvalidScope }, func(_ *Context) error {
+		undone++
+		return nil
+	})
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			WithCompensation(func(_ *Context) error { return nil }, func(_ *Context) error {
+				undone++
+				return nil
+			}),
+			WithErrorHandler(failing, func(_ error, _ *Context) {}),
+		},
+		Name:   "TestQueue",
+		Logger: &testLogger{},
+	})
+
+	result := queue.Run(map[string]any{})
+
+	if undone != 0 || result.Err != nil || result.Aborted || len(result.Compensations) != 0 {
+		t.Fatalf("expected no compensation, got %d runs and %+v", undone, result)
+	}
+}
+
+func TestCompensationsRunWhenHandlerContinues(t *testing.T) {
+	undone := 0
+	soft := errors.New("soft")
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			WithCompensation(func(_ *Context) error { return nil }, func(_ *Context) error {
+				undone++
+				return nil
+			}),
+			anyAction(func(_ *Context) error { return soft }),
+			anyAction(func(_ *Context) error { return nil }),
+		},
+		Name:    "TestQueue",
+		Logger:  &testLogger{},
+		OnError: func(_ error, _ *Context) {},
+	})
+
+	result := queue.Run(map[string]any{})
+
+	if !errors.Is(result.Err, soft) || result.Aborted {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if undone != 1 || len(result.Compensations) != 1 {
+		t.Fatalf("expected compensation after a recovered error, got %d runs and %+v", undone, result.Compensations)
+	}
+}
+
+func TestCompensationRegisteredOnceAcrossRestarts(t *testing.T) {
+	undone := 0
+	restarts := 0
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			WithCompensation(func(_ *Context) error { return nil }, func(_ *Context) error {
+				undone++
+				return nil
+			}),
+			anyAction(func(ctx *Context) error {
+				if restarts < 2 {
+					restarts++
+					return ctx.Restart()
+				}
+				ctx.Abort()
+				return nil
+			}),
+		},
+		Name:   "TestQueue",
+		Logger: &testLogger{},
+	})
+
+	result := queue.Run(map[string]any{})
+
+	if !result.Aborted || undone != 1 || len(result.Compensations) != 1 {
+		t.Fatalf("expected one compensation after restarts, got %d runs and %+v", undone, result)
+	}
+}
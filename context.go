@@ -1,5 +1,10 @@
 package queuerunner
 
+import (
+	"context"
+	"time"
+)
+
 type Context struct {
 	Data   map[string]any
 	Logger Logger
@@ -8,6 +13,27 @@ type Context struct {
 	nameFn  func() string
 	abortFn func()
 	locking LockingContext
+	owner   *LockOwner
+	action  string
+	probe   *actionInfo
+	current context.Context
+	leases  map[string]*Lease
+
+	compensateFn  func(undo *compensation)
+	appendFn      func(actions []Action)
+	insertAfterFn func(label string, actions []Action) error
+	remainingFn   func() []Action
+	goToFn        func(label string) error
+	skipUntilFn   func(label string) error
+	restartFn     func() error
+	sleepFn       func(delay time.Duration)
+	emitFn        func(build func(info EventInfo) Event)
+	acquireLockFn func(scope string) error
+	releaseLockFn func(scope string) error
+	detachFn      func() func()
+
+	// locked counts the lock-scoped actions the queue is running.
+	locked int
 }
 
 func newContext(pushFn func([]Action), nameFn func() string, abortFn func(), locking LockingContext) *Context {
@@ -53,6 +79,113 @@ func (ctx *Context) Push(actions []Action) {
 	ctx.pushFn(actions)
 }
 
+func (ctx *Context) Append(actions []Action) {
+	if ctx.appendFn == nil {
+		return
+	}
+	ctx.appendFn(actions)
+}
+
+func (ctx *Context) InsertAfter(label string, actions []Action) error {
+	if ctx.insertAfterFn == nil {
+		return ErrLabelNotFound
+	}
+	return ctx.insertAfterFn(label, actions)
+}
+
+func (ctx *Context) Remaining() []Action {
+	if ctx.remainingFn == nil {
+		return nil
+	}
+	return ctx.remainingFn()
+}
+
+func (ctx *Context) GoTo(label string) error {
+	if ctx.goToFn == nil {
+		return ErrLabelNotFound
+	}
+	return ctx.goToFn(label)
+}
+
+func (ctx *Context) SkipUntil(label string) error {
+	if ctx.skipUntilFn == nil {
+		return ErrLabelNotFound
+	}
+	return ctx.skipUntilFn(label)
+}
+
+func (ctx *Context) Restart() error {
+	if ctx.restartFn == nil {
+		return nil
+	}
+	return ctx.restartFn()
+}
+
+func (ctx *Context) sleep(delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	if ctx == nil || ctx.sleepFn == nil {
+		time.Sleep(delay)
+		return
+	}
+	ctx.sleepFn(delay)
+}
+
+// lockContext carries the queue's lock owner and the name of the running
+// action to the locking context. It is cancelled with Context, so waits
+// made under an expired lease give up.
+func (ctx *Context) lockContext() context.Context {
+	lockCtx := contextWithQueueContext(ctx.Context(), ctx)
+	if ctx.owner != nil {
+		lockCtx = ContextWithLockOwner(lockCtx, ctx.owner)
+	}
+	if ctx.action != "" {
+		lockCtx = ContextWithLockAction(lockCtx, ctx.action)
+	}
+	return lockCtx
+}
+
+// waitingLockContext returns the lock context for a request to locking and
+// a function that takes a worker back once the request is done. A
+// LockManager says when a request has to wait, so the queue leaves its
+// worker only then; other locking contexts may block anywhere, so the queue
+// leaves it up front.
+func (ctx *Context) waitingLockContext(locking LockingContext) (context.Context, func()) {
+	lockCtx := ctx.lockContext()
+	var rejoin func()
+	if _, ok := locking.(*LockManager); ok {
+		lockCtx = contextWithLockWait(lockCtx, func() {
+			if rejoin == nil {
+				rejoin = ctx.detach()
+			}
+		})
+	} else {
+		rejoin = ctx.detach()
+	}
+
+	return lockCtx, func() {
+		if rejoin != nil {
+			rejoin()
+			rejoin = nil
+		}
+	}
+}
+
+func (ctx *Context) detach() func() {
+	if ctx == nil || ctx.detachFn == nil {
+		return func() {}
+	}
+	return ctx.detachFn()
+}
+
+func (ctx *Context) emit(build func(info EventInfo) Event) {
+	if ctx == nil || ctx.emitFn == nil {
+		return
+	}
+	ctx.emitFn(build)
+}
+
 func (ctx *Context) Get(key string) (any, bool) {
 	if ctx.Data == nil {
 		return nil, false
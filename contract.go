@@ -0,0 +1,221 @@
+package queuerunner
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var (
+	ErrMissingInput    = errors.New("missing input")
+	ErrInputType       = errors.New("input has unexpected type")
+	ErrMissingOutput   = errors.New("missing output")
+	ErrMissingProducer = errors.New("no action produces input")
+)
+
+type Key struct {
+	Name string
+	Type reflect.Type
+}
+
+func KeyOf[T any](name string) Key {
+	return Key{Name: name, Type: reflect.TypeOf((*T)(nil)).Elem()}
+}
+
+type Contract struct {
+	Inputs  []Key
+	Outputs []Key
+}
+
+type ContractError struct {
+	Action string
+	Key    Key
+	Got    reflect.Type
+	Err    error
+}
+
+func (err *ContractError) Error() string {
+	message := fmt.Sprintf("%s: %v %q", err.Action, err.Err, err.Key.Name)
+	if err.Key.Type != nil {
+		message += fmt.Sprintf(" (want %v", err.Key.Type)
+		if err.Got != nil {
+			message += fmt.Sprintf(", got %v", err.Got)
+		}
+		message += ")"
+	}
+	return message
+}
+
+func (err *ContractError) Unwrap() error {
+	return err.Err
+}
+
+func WithContract(action Action, contract Contract) Action {
+	name := actionName(action)
+
+	return wrapAction(action, func(ctx *Context) error {
+		if err := checkKeys(ctx.Data, contract.Inputs, name, ErrMissingInput); err != nil {
+			return err
+		}
+		if err := action(ctx); err != nil {
+			return err
+		}
+		return checkKeys(ctx.Data, contract.Outputs, name, ErrMissingOutput)
+	}, func(info *actionInfo) {
+		info.contract = &contract
+	})
+}
+
+func ValidateActions(actions []Action, initial map[string]any) error {
+	requires, err := analyzeActions(actions)
+	if err != nil {
+		return err
+	}
+	return checkRequired(requires, initial)
+}
+
+func checkKeys(data map[string]any, keys []Key, action string, missing error) error {
+	errs := []error{}
+	for _, key := range keys {
+		value, ok := data[key.Name]
+		if !ok {
+			errs = append(errs, &ContractError{Action: action, Key: key, Err: missing})
+			continue
+		}
+		if !matchesType(value, key.Type) {
+			errs = append(errs, &ContractError{Action: action, Key: key, Got: reflect.TypeOf(value), Err: ErrInputType})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func matchesType(value any, want reflect.Type) bool {
+	if want == nil {
+		return true
+	}
+	if value == nil {
+		switch want.Kind() {
+		case reflect.Interface, reflect.Pointer, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+			return true
+		}
+		return false
+	}
+	return reflect.TypeOf(value).AssignableTo(want)
+}
+
+type requiredKey struct {
+	action string
+	key    Key
+}
+
+func checkRequired(requires []requiredKey, initial map[string]any) error {
+	errs := []error{}
+	for _, required := range requires {
+		value, ok := initial[required.key.Name]
+		if !ok {
+			errs = append(errs, &ContractError{Action: required.action, Key: required.key, Err: ErrMissingProducer})
+			continue
+		}
+		if !matchesType(value, required.key.Type) {
+			errs = append(errs, &ContractError{Action: required.action, Key: required.key, Got: reflect.TypeOf(value), Err: ErrInputType})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// analyzeActions walks the pipeline, following Util.If and Util.Valid
+// branches, and returns the inputs no earlier action produces. Those have to
+// come from the initial data. Keys produced only by some branches of a
+// condition are not considered available after it. An action without a
+// contract may produce anything, so inputs missing after one are left to
+// the check at runtime.
+func analyzeActions(actions []Action) ([]requiredKey, error) {
+	analysis := &pipelineAnalysis{}
+	analysis.walk(actions, map[string]reflect.Type{}, false)
+	return analysis.requires, errors.Join(analysis.errs...)
+}
+
+type pipelineAnalysis struct {
+	requires []requiredKey
+	errs     []error
+}
+
+// walk adds the keys actions produce to available and reports whether an
+// undeclared action ran, starting from open.
+func (analysis *pipelineAnalysis) walk(actions []Action, available map[string]reflect.Type, open bool) bool {
+	for _, action := range actions {
+		info := describeAction(action)
+
+		if info.contract == nil && len(info.branches) == 0 {
+			open = true
+			continue
+		}
+
+		if info.contract != nil {
+			name := actionName(action)
+			for _, input := range info.contract.Inputs {
+				produced, ok := available[input.Name]
+				if !ok {
+					if !open {
+						analysis.require(name, input)
+					}
+					continue
+				}
+				if produced != nil && input.Type != nil && !produced.AssignableTo(input.Type) {
+					analysis.errs = append(analysis.errs, &ContractError{Action: name, Key: input, Got: produced, Err: ErrInputType})
+				}
+			}
+			for _, output := range info.contract.Outputs {
+				available[output.Name] = output.Type
+			}
+		}
+
+		if len(info.branches) == 0 {
+			continue
+		}
+
+		// A branch with an undeclared action does not narrow the keys the
+		// other branches produce; after the condition the pipeline is open
+		// only if every branch is.
+		var common map[string]reflect.Type
+		branchesOpen := true
+		for _, branch := range info.branches {
+			scope := copyTypes(available)
+			if analysis.walk(branch, scope, open) {
+				continue
+			}
+			branchesOpen = false
+			if common == nil {
+				common = scope
+				continue
+			}
+			for key := range common {
+				if _, ok := scope[key]; !ok {
+					delete(common, key)
+				}
+			}
+		}
+		for key, keyType := range common {
+			available[key] = keyType
+		}
+		open = open || branchesOpen
+	}
+	return open
+}
+
+func (analysis *pipelineAnalysis) require(action string, key Key) {
+	for _, required := range analysis.requires {
+		if required.key == key {
+			return
+		}
+	}
+	analysis.requires = append(analysis.requires, requiredKey{action: action, key: key})
+}
+
+func copyTypes(types map[string]reflect.Type) map[string]reflect.Type {
+	result := make(map[string]reflect.Type, len(types))
+	for key, value := range types {
+		result[key] = value
+	}
+	return result
+}
@@ -0,0 +1,149 @@
+package queuerunner
+
+import (
+	"errors"
+	"testing"
+)
+
+func fetchAction() Action {
+	return WithContract(func(ctx *Context) error {
+		ctx.Set("body", []byte("ok"))
+		return nil
+	}, Contract{
+		Inputs:  []Key{KeyOf[string]("url")},
+		Outputs: []Key{KeyOf[[]byte]("body")},
+	})
+}
+
+func parseAction() Action {
+	return WithContract(func(ctx *Context) error {
+		ctx.Set("size", len(ctx.Data["body"].([]byte)))
+		return nil
+	}, Contract{
+		Inputs:  []Key{KeyOf[[]byte]("body")},
+		Outputs: []Key{KeyOf[int]("size")},
+	})
+}
+
+func TestValidateActionsFollowsProducers(t *testing.T) {
+	actions := []Action{fetchAction(), WithLock("browser", parseAction())}
+
+	if err := ValidateActions(actions, map[string]any{"url": "http://example.com"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err := ValidateActions(actions, map[string]any{})
+	if !errors.Is(err, ErrMissingProducer) {
+		t.Fatalf("expected missing producer, got %v", err)
+	}
+
+	err = ValidateActions(actions, map[string]any{"url": 42})
+	if !errors.Is(err, ErrInputType) {
+		t.Fatalf("expected type error, got %v", err)
+	}
+}
+
+func TestValidateActionsFollowsIfBranches(t *testing.T) {
+	condition := func(_ *Context) (bool, error) { return true, nil }
+
+	onlyThen := []Action{
+		Util.If(condition, Branches{Then: []Action{fetchAction()}}),
+		parseAction(),
+	}
+	var contractErr *ContractError
+	err := ValidateActions(onlyThen, map[string]any{"url": "u"})
+	if !errors.As(err, &contractErr) || contractErr.Key.Name != "body" {
+		t.Fatalf("expected body to be reported missing, got %v", err)
+	}
+
+	bothBranches := []Action{
+		Util.If(condition, Branches{
+			Then: []Action{fetchAction()},
+			Else: []Action{WithContract(func(ctx *Context) error {
+				ctx.Set("body", []byte{})
+				return nil
+			}, Contract{Outputs: []Key{KeyOf[[]byte]("body")}})},
+		}),
+		parseAction(),
+	}
+	if err := ValidateActions(bothBranches, map[string]any{"url": "u"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateActionsTrustsUndeclaredProducers(t *testing.T) {
+	produceBody := anyAction(func(ctx *Context) error {
+		ctx.Set("body", []byte("ok"))
+		return nil
+	})
+
+	if err := ValidateActions([]Action{produceBody, parseAction()}, map[string]any{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{produceBody, parseAction()},
+		Name:    "TestQueue",
+		Logger:  &testLogger{},
+	})
+	if result := queue.Run(map[string]any{}); result.Err != nil {
+		t.Fatalf("unexpected error: %v", result.Err)
+	}
+
+	condition := func(_ *Context) (bool, error) { return true, nil }
+	maybe := []Action{
+		Util.If(condition, Branches{Then: []Action{produceBody}}),
+		parseAction(),
+	}
+	if err := ValidateActions(maybe, map[string]any{}); !errors.Is(err, ErrMissingProducer) {
+		t.Fatalf("expected missing producer after a skippable branch, got %v", err)
+	}
+}
+
+func TestQueueDoesNotRunInvalidPipeline(t *testing.T) {
+	logger := &testLogger{}
+	ran := false
+
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			WithContract(func(_ *Context) error { ran = true; return nil }, Contract{}),
+			parseAction(),
+		},
+		Name:   "TestQueue",
+		Logger: logger,
+	})
+
+	queue.Run(map[string]any{"logger": logger})
+
+	if ran {
+		t.Fatal("expected invalid pipeline not to run")
+	}
+	if logger.ErrorCount() != 1 {
+		t.Fatalf("expected validation error to be logged, got %d", logger.ErrorCount())
+	}
+}
+
+func TestWithContractRuntimeErrors(t *testing.T) {
+	missingOutput := WithContract(func(_ *Context) error {
+		return nil
+	}, Contract{Outputs: []Key{KeyOf[int]("size")}})
+
+	err := missingOutput(&Context{Data: map[string]any{}})
+	if !errors.Is(err, ErrMissingOutput) {
+		t.Fatalf("expected missing output, got %v", err)
+	}
+
+	err = parseAction()(&Context{Data: map[string]any{"body": "text"}})
+	var contractErr *ContractError
+	if !errors.As(err, &contractErr) || contractErr.Key.Name != "body" || contractErr.Got == nil {
+		t.Fatalf("expected typed input error, got %v", err)
+	}
+}
+
+func TestRunnerAddRejectsInvalidPipeline(t *testing.T) {
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}})
+
+	if err := runner.Add([]Action{parseAction()}, map[string]any{}, ""); !errors.Is(err, ErrMissingProducer) {
+		t.Fatalf("expected missing producer, got %v", err)
+	}
+}
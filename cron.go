@@ -0,0 +1,232 @@
+package queuerunner
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCron = errors.New("invalid cron expression")
+
+// CronSchedule is a parsed standard 5-field cron expression:
+// minute, hour, day of month, month and day of week.
+type CronSchedule struct {
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool
+	dowStar bool
+	// fixedTime is set when neither minute nor hour starts with "*". Like
+	// in Vixie cron, only such schedules skip the repeated hour in autumn;
+	// the others keep following absolute time.
+	fixedTime bool
+}
+
+type cronField struct {
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	cronMinute = cronField{min: 0, max: 59}
+	cronHour   = cronField{min: 0, max: 23}
+	cronDom    = cronField{min: 1, max: 31}
+	cronMonth  = cronField{min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDow = cronField{min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+func ParseCron(spec string) (*CronSchedule, error) {
+	expression := strings.TrimSpace(spec)
+	if macro, ok := cronMacros[strings.ToLower(expression)]; ok {
+		expression = macro
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: %q needs 5 fields", ErrInvalidCron, spec)
+	}
+
+	schedule := &CronSchedule{}
+	var err error
+	if schedule.minute, err = cronMinute.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if schedule.hour, err = cronHour.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if schedule.dom, err = cronDom.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if schedule.month, err = cronMonth.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if schedule.dow, err = cronDow.parse(fields[4]); err != nil {
+		return nil, err
+	}
+
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+	schedule.domStar = starField(fields[2])
+	schedule.dowStar = starField(fields[4])
+	schedule.fixedTime = !starField(fields[0]) && !starField(fields[1])
+
+	return schedule, nil
+}
+
+func starField(expression string) bool {
+	return expression == "*" || strings.HasPrefix(expression, "*/")
+}
+
+func (field cronField) parse(expression string) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(expression, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			parsed, err := strconv.Atoi(stepPart)
+			if err != nil || parsed <= 0 {
+				return 0, fmt.Errorf("%w: bad step in %q", ErrInvalidCron, part)
+			}
+			step = parsed
+		}
+
+		low, high := field.min, field.max
+		if rangePart != "*" {
+			start, end, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = field.value(start); err != nil {
+				return 0, err
+			}
+			high = low
+			if isRange {
+				if high, err = field.value(end); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				high = field.max
+			}
+			if low > high {
+				return 0, fmt.Errorf("%w: empty range %q", ErrInvalidCron, part)
+			}
+		}
+
+		for value := low; value <= high; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+
+	return bits, nil
+}
+
+func (field cronField) value(text string) (int, error) {
+	if value, ok := field.names[strings.ToLower(text)]; ok {
+		return value, nil
+	}
+
+	value, err := strconv.Atoi(text)
+	if err != nil || value < field.min || value > field.max {
+		return 0, fmt.Errorf("%w: %q is out of range %d-%d", ErrInvalidCron, text, field.min, field.max)
+	}
+	return value, nil
+}
+
+// Next returns the first time after the given one that matches the schedule,
+// evaluated in the location of after. It returns the zero time when nothing
+// matches within five years, for example for "0 0 31 2 *". Wall-clock times
+// skipped by a daylight saving change never match. Times repeated by one
+// match once for fixed-time schedules such as "30 1 * * *", which must be
+// later than after on the wall clock too, and twice for schedules with "*"
+// in the minute or hour, such as "*/5 * * * *".
+func (schedule *CronSchedule) Next(after time.Time) time.Time {
+	location := after.Location()
+	current := after.Truncate(time.Minute).Add(time.Minute)
+	limit := after.AddDate(5, 0, 0)
+	wall := wallClock(after)
+
+	for current.Before(limit) {
+		if schedule.month&(1<<uint(current.Month())) == 0 {
+			current = advance(current, time.Date(current.Year(), current.Month()+1, 1, 0, 0, 0, 0, location))
+			continue
+		}
+		if !schedule.matchesDay(current) {
+			current = advance(current, time.Date(current.Year(), current.Month(), current.Day()+1, 0, 0, 0, 0, location))
+			continue
+		}
+		if schedule.hour&(1<<uint(current.Hour())) == 0 {
+			current = nextHour(current)
+			continue
+		}
+		if schedule.minute&(1<<uint(current.Minute())) == 0 || schedule.repeated(current, wall) {
+			current = current.Add(time.Minute)
+			continue
+		}
+		return current
+	}
+
+	return time.Time{}
+}
+
+// repeated reports whether a fixed-time schedule must skip candidate
+// because its wall-clock time is not later than wall, which happens only in
+// the hour repeated in autumn.
+func (schedule *CronSchedule) repeated(candidate time.Time, wall time.Time) bool {
+	return schedule.fixedTime && !wallClock(candidate).After(wall)
+}
+
+// advance moves to the start of a later day or month. time.Date may resolve
+// a midnight skipped by a daylight saving change to an earlier instant, so
+// the search then moves on by the hour instead, which always goes forward.
+func advance(current, next time.Time) time.Time {
+	if next.After(current) {
+		return next
+	}
+	return nextHour(current)
+}
+
+// nextHour moves to the next full hour in absolute time. Going through
+// time.Date instead would map an hour skipped in spring back onto the
+// current one and never get past it.
+func nextHour(current time.Time) time.Time {
+	return current.Add(time.Duration(60-current.Minute()) * time.Minute)
+}
+
+// wallClock returns the local date and time of t without its offset, so
+// that the two occurrences of a repeated hour compare equal.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+// matchesDay follows the usual cron rule: when both day of month and day of
+// week are restricted, a day matching either of them is enough.
+func (schedule *CronSchedule) matchesDay(t time.Time) bool {
+	domMatch := schedule.dom&(1<<uint(t.Day())) != 0
+	dowMatch := schedule.dow&(1<<uint(t.Weekday())) != 0
+
+	if schedule.domStar || schedule.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
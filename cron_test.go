@@ -0,0 +1,150 @@
+package queuerunner
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseCronRejectsInvalidSpecs(t *testing.T) {
+	specs := []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "* * * foo *"}
+
+	for _, spec := range specs {
+		if _, err := ParseCron(spec); !errors.Is(err, ErrInvalidCron) {
+			t.Fatalf("expected %q to be rejected, got %v", spec, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 17, 30, 0, time.UTC) // Monday
+	cases := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 1, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"30 8 * * sat,sun", time.Date(2024, 1, 6, 8, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 mar *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Day of month and day of week both restricted: either one matches.
+		{"0 0 15 * fri", time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range cases {
+		schedule, err := ParseCron(test.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", test.spec, err)
+		}
+		if next := schedule.Next(start); !next.Equal(test.expected) {
+			t.Fatalf("%q: expected %v, got %v", test.spec, test.expected, next)
+		}
+	}
+}
+
+func TestCronNextUsesLocation(t *testing.T) {
+	location := time.FixedZone("UTC+3", 3*60*60)
+	schedule, err := ParseCron("0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := schedule.Next(time.Date(2024, 1, 1, 7, 0, 0, 0, time.UTC).In(location))
+	if expected := time.Date(2024, 1, 2, 6, 0, 0, 0, time.UTC); !next.Equal(expected) {
+		t.Fatalf("expected %v, got %v", expected, next)
+	}
+}
+
+func TestCronNextNeverMatches(t *testing.T) {
+	schedule, err := ParseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := schedule.Next(time.Now()); !next.IsZero() {
+		t.Fatalf("expected no match, got %v", next)
+	}
+}
+
+func TestCronNextSpringForward(t *testing.T) {
+	for _, name := range []string{"America/New_York", "America/Los_Angeles"} {
+		location, err := time.LoadLocation(name)
+		if err != nil {
+			t.Skip(err)
+		}
+		cases := []struct {
+			spec     string
+			after    time.Time
+			expected time.Time
+		}{
+			{"0 9 * * *", time.Date(2024, 3, 9, 12, 0, 0, 0, location), time.Date(2024, 3, 10, 9, 0, 0, 0, location)},
+			// 02:30 does not exist on March 10.
+			{"30 2 * * *", time.Date(2024, 3, 10, 1, 30, 0, 0, location), time.Date(2024, 3, 11, 2, 30, 0, 0, location)},
+			{"0 * * * *", time.Date(2024, 3, 10, 1, 30, 0, 0, location), time.Date(2024, 3, 10, 3, 0, 0, 0, location)},
+		}
+
+		for _, test := range cases {
+			schedule, err := ParseCron(test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next := schedule.Next(test.after); !next.Equal(test.expected) {
+				t.Fatalf("%s %q: expected %v, got %v", name, test.spec, test.expected, next)
+			}
+		}
+	}
+}
+
+func TestCronNextFallBackFiresOnce(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	schedule, err := ParseCron("30 1 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := schedule.Next(time.Date(2024, 11, 3, 0, 0, 0, 0, location))
+	if _, offset := first.Zone(); first.Hour() != 1 || first.Minute() != 30 || offset != -4*60*60 {
+		t.Fatalf("expected 01:30 EDT, got %v", first)
+	}
+	if next := schedule.Next(first); !next.Equal(time.Date(2024, 11, 4, 1, 30, 0, 0, location)) {
+		t.Fatalf("expected the repeated 01:30 to be skipped, got %v", next)
+	}
+}
+
+func TestCronNextFallBackKeepsIntervals(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	cases := []struct {
+		spec  string
+		after time.Time
+		every time.Duration
+		runs  int
+	}{
+		// 01:55 EDT, 01:00 EST, 01:05 EST, ...: every 5 minutes of real time.
+		{"*/5 * * * *", time.Date(2024, 11, 3, 1, 50, 0, 0, location), 5 * time.Minute, 14},
+		// 01:00 EDT, 01:00 EST, 02:00 EST.
+		{"0 * * * *", time.Date(2024, 11, 3, 0, 0, 0, 0, location).Add(time.Hour), time.Hour, 2},
+	}
+
+	for _, test := range cases {
+		schedule, err := ParseCron(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		previous := test.after
+		for run := 0; run < test.runs; run++ {
+			next := schedule.Next(previous)
+			if next.Sub(previous) != test.every {
+				t.Fatalf("%q: expected a run %v after %v, got %v", test.spec, test.every, previous, next)
+			}
+			previous = next
+		}
+	}
+}
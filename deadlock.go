@@ -0,0 +1,175 @@
+package queuerunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var ErrDeadlock = errors.New("lock request would deadlock")
+
+// LockOwner identifies who holds and waits for scopes. Every queue has its
+// own owner, named after the queue; code using a LockManager directly can
+// create one and attach it with ContextWithLockOwner.
+type LockOwner struct {
+	Name string
+}
+
+func NewLockOwner(name string) *LockOwner {
+	return &LockOwner{Name: name}
+}
+
+type lockOwnerKey struct{}
+
+func ContextWithLockOwner(ctx context.Context, owner *LockOwner) context.Context {
+	return context.WithValue(ctx, lockOwnerKey{}, owner)
+}
+
+func lockOwnerOf(ctx context.Context) *LockOwner {
+	owner, _ := ctx.Value(lockOwnerKey{}).(*LockOwner)
+	return owner
+}
+
+// DeadlockError is returned to the request that would have closed a cycle
+// in the wait-for graph. Cycle lists the owners involved, starting and
+// ending with the requesting one.
+type DeadlockError struct {
+	Scopes []string
+	Cycle  []string
+}
+
+func (err *DeadlockError) Error() string {
+	return fmt.Sprintf("%v: waiting for %s, cycle %s", ErrDeadlock, strings.Join(err.Scopes, ", "), strings.Join(err.Cycle, " -> "))
+}
+
+func (err *DeadlockError) Unwrap() error {
+	return ErrDeadlock
+}
+
+// detectDeadlock follows the wait-for graph from the waiter's owner: an
+// owner waits for the owners holding a conflicting hold on a scope it
+// asked for and, with FIFO ordering, for the owners queued ahead of it. If
+// the walk comes back to the waiter's owner, waiting would never end.
+// Requests without an owner are not tracked.
+func (manager *LockManager) detectDeadlock(waiter *lockWaiter) error {
+	if waiter.owner == nil {
+		return nil
+	}
+
+	path := []*LockOwner{waiter.owner}
+	visited := map[*LockOwner]bool{}
+	var walk func(owner *LockOwner) bool
+	walk = func(owner *LockOwner) bool {
+		for _, next := range manager.waitsFor(owner) {
+			if next == waiter.owner {
+				path = append(path, next)
+				return true
+			}
+			if visited[next] {
+				continue
+			}
+			visited[next] = true
+			path = append(path, next)
+			if walk(next) {
+				return true
+			}
+			path = path[:len(path)-1]
+		}
+		return false
+	}
+
+	if !walk(waiter.owner) {
+		return nil
+	}
+
+	cycle := make([]string, len(path))
+	for index, owner := range path {
+		cycle[index] = owner.Name
+	}
+	scopes := make([]string, len(waiter.scopes))
+	for index, state := range waiter.scopes {
+		scopes[index] = state.name
+	}
+	return &DeadlockError{Scopes: scopes, Cycle: cycle}
+}
+
+func (manager *LockManager) waitsFor(owner *LockOwner) []*LockOwner {
+	var owners []*LockOwner
+	for waiter := range manager.waiters {
+		if waiter.owner == owner {
+			owners = append(owners, waiter.blockers()...)
+		}
+	}
+	return owners
+}
+
+func (waiter *lockWaiter) blockers() []*LockOwner {
+	var owners []*LockOwner
+	for _, state := range waiter.scopes {
+		for _, hold := range state.holds {
+			if hold.owner != nil && waiter.conflicts(hold) {
+				owners = append(owners, hold.owner)
+			}
+		}
+		for _, ahead := range state.queue {
+			if ahead == waiter {
+				break
+			}
+			if ahead.owner != nil && ahead.owner != waiter.owner {
+				owners = append(owners, ahead.owner)
+			}
+		}
+	}
+	return owners
+}
+
+// conflicts reports whether the hold keeps the waiter out for certain.
+// Semaphore holders are left out: another one may free a slot.
+func (waiter *lockWaiter) conflicts(hold *lockHold) bool {
+	if waiter.mode == exclusiveLock {
+		return true
+	}
+	return hold.mode == exclusiveLock
+}
+
+// Dump describes every scope that is held or waited for, one per line,
+// for debugging stalls.
+func (manager *LockManager) Dump() string {
+	var builder strings.Builder
+	for _, entry := range manager.Snapshot() {
+		holders := make([]string, len(entry.Holders))
+		for index, holder := range entry.Holders {
+			holders[index] = fmt.Sprintf("%s (%s)", displayName(holder.Queue), holder.Mode)
+			if holder.Count > 1 {
+				holders[index] = fmt.Sprintf("%s (%s x%d)", displayName(holder.Queue), holder.Mode, holder.Count)
+			}
+		}
+		waiters := make([]string, len(entry.Waiters))
+		for index, waiter := range entry.Waiters {
+			waiters[index] = fmt.Sprintf("%s (%s)", displayName(waiter.Queue), waiter.Mode)
+		}
+		sort.Strings(waiters)
+
+		fmt.Fprintf(&builder, "%s: held by [%s], waiting [%s]\n", entry.Scope, strings.Join(holders, ", "), strings.Join(waiters, ", "))
+	}
+	return builder.String()
+}
+
+func displayName(queue string) string {
+	if queue == "" {
+		return "unknown"
+	}
+	return queue
+}
+
+func (mode lockMode) String() string {
+	switch mode {
+	case sharedLock:
+		return "shared"
+	case semaphoreLock:
+		return "semaphore"
+	}
+	return "exclusive"
+}
@@ -0,0 +1,129 @@
+package queuerunner
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockManagerDetectsDeadlock(t *testing.T) {
+	for _, ordering := range []LockOrdering{LockFIFO, LockRacing} {
+		manager := NewLockManagerWithOpts(LockManagerOpts{Ordering: ordering})
+		first := ContextWithLockOwner(context.Background(), NewLockOwner("first"))
+		second := ContextWithLockOwner(context.Background(), NewLockOwner("second"))
+
+		if err := manager.LockContext(first, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if err := manager.LockContext(second, "b"); err != nil {
+			t.Fatal(err)
+		}
+
+		waiting := make(chan error, 1)
+		go func() { waiting <- manager.LockContext(first, "b") }()
+		deadline := time.Now().Add(time.Second)
+		for !strings.Contains(manager.Dump(), "waiting [first (exclusive)]") && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		err := manager.LockContext(second, "a")
+		var deadlock *DeadlockError
+		if !errors.Is(err, ErrDeadlock) || !errors.As(err, &deadlock) {
+			t.Fatalf("ordering %d: expected deadlock, got %v", ordering, err)
+		}
+		if strings.Join(deadlock.Cycle, ",") != "second,first,second" || deadlock.Scopes[0] != "a" {
+			t.Fatalf("ordering %d: unexpected deadlock: %v", ordering, deadlock)
+		}
+
+		manager.Unlock("b")
+		if err := <-waiting; err != nil {
+			t.Fatalf("ordering %d: expected the surviving waiter to proceed, got %v", ordering, err)
+		}
+	}
+}
+
+func TestLockManagerSharedHoldersAreNotADeadlock(t *testing.T) {
+	manager := NewLockManager()
+	first := ContextWithLockOwner(context.Background(), NewLockOwner("first"))
+	second := ContextWithLockOwner(context.Background(), NewLockOwner("second"))
+
+	if err := manager.RLockContext(first, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.RLockContext(second, "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	waiting := make(chan error, 1)
+	go func() { waiting <- manager.RLockContext(first, "b") }()
+	if err := manager.RLockContext(second, "a"); err != nil {
+		t.Fatalf("expected readers to share scopes, got %v", err)
+	}
+	if err := <-waiting; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockManagerDump(t *testing.T) {
+	manager := NewLockManager()
+	holder := ContextWithLockOwner(context.Background(), NewLockOwner("holder"))
+	if err := manager.LockContext(holder, "browser"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		waiter := ContextWithLockOwner(context.Background(), NewLockOwner("waiter"))
+		_ = manager.RunWithRLockContext(waiter, "browser", func() error { return nil })
+	}()
+	waitQueued(t, manager, "browser", 1)
+
+	expected := "browser: held by [holder (exclusive)], waiting [waiter (shared)]\n"
+	if dump := manager.Dump(); dump != expected {
+		t.Fatalf("unexpected dump:\n%s", dump)
+	}
+
+	manager.Unlock("browser")
+	<-done
+	if dump := manager.Dump(); dump != "" {
+		t.Fatalf("expected empty dump, got:\n%s", dump)
+	}
+}
+
+func TestNestedLockInQueueReportsDeadlock(t *testing.T) {
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			WithLock("browser", func(ctx *Context) error {
+				return WithLock("browser", func(_ *Context) error { return nil })(ctx)
+			}),
+		},
+		Name:   "nested",
+		Logger: &testLogger{},
+	})
+	subscription := queue.Subscribe(64)
+
+	result := make(chan RunResult, 1)
+	go func() { result <- queue.Run(map[string]any{}) }()
+
+	select {
+	case result := <-result:
+		if !errors.Is(result.Err, ErrDeadlock) {
+			t.Fatalf("expected ErrDeadlock, got %v", result.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("nested lock of the same scope hung")
+	}
+
+	var deadlock LockDeadlock
+	for _, event := range collectEvents(subscription) {
+		if event, ok := event.(LockDeadlock); ok {
+			deadlock = event
+		}
+	}
+	if strings.Join(deadlock.Cycle, ",") != "nested,nested" {
+		t.Fatalf("expected deadlock event, got %+v", deadlock)
+	}
+}
@@ -0,0 +1,136 @@
+package queuerunner
+
+const minDequeCapacity = 16
+
+// stepDeque is a ring buffer of queue steps. Pushing to either end and
+// popping from the front are O(1) amortized and never share memory with the
+// slices passed in by callers.
+type stepDeque struct {
+	items []queueStep
+	head  int
+	size  int
+}
+
+func newStepDeque(actions []Action) *stepDeque {
+	deque := &stepDeque{}
+	deque.pushBack(actions, 0)
+	return deque
+}
+
+func (deque *stepDeque) Len() int {
+	return deque.size
+}
+
+func (deque *stepDeque) at(index int) queueStep {
+	return deque.items[(deque.head+index)%len(deque.items)]
+}
+
+func (deque *stepDeque) pushFront(actions []Action, depth int) {
+	deque.grow(len(actions))
+	for index := len(actions) - 1; index >= 0; index-- {
+		deque.head = (deque.head - 1 + len(deque.items)) % len(deque.items)
+		deque.items[deque.head] = queueStep{action: actions[index], depth: depth}
+		deque.size++
+	}
+}
+
+func (deque *stepDeque) pushBack(actions []Action, depth int) {
+	deque.grow(len(actions))
+	for _, action := range actions {
+		deque.items[(deque.head+deque.size)%len(deque.items)] = queueStep{action: action, depth: depth}
+		deque.size++
+	}
+}
+
+// insert places actions before position index. It shifts the shorter side of
+// the ring, so inserting near either end stays cheap.
+func (deque *stepDeque) insert(index int, actions []Action, depth int) {
+	if index <= 0 {
+		deque.pushFront(actions, depth)
+		return
+	}
+	if index >= deque.size {
+		deque.pushBack(actions, depth)
+		return
+	}
+
+	count := len(actions)
+	deque.grow(count)
+	capacity := len(deque.items)
+
+	if index < deque.size-index {
+		deque.head = (deque.head - count + capacity) % capacity
+		for offset := 0; offset < index; offset++ {
+			deque.items[(deque.head+offset)%capacity] = deque.items[(deque.head+offset+count)%capacity]
+		}
+	} else {
+		for offset := deque.size - 1; offset >= index; offset-- {
+			deque.items[(deque.head+offset+count)%capacity] = deque.items[(deque.head+offset)%capacity]
+		}
+	}
+
+	for offset, action := range actions {
+		deque.items[(deque.head+index+offset)%capacity] = queueStep{action: action, depth: depth}
+	}
+	deque.size += count
+}
+
+func (deque *stepDeque) popFront() (queueStep, bool) {
+	if deque.size == 0 {
+		return queueStep{}, false
+	}
+
+	step := deque.items[deque.head]
+	deque.items[deque.head] = queueStep{}
+	deque.head = (deque.head + 1) % len(deque.items)
+	deque.size--
+	return step, true
+}
+
+func (deque *stepDeque) dropFront(count int) {
+	for ; count > 0; count-- {
+		deque.popFront()
+	}
+}
+
+func (deque *stepDeque) reset(actions []Action, depth int) {
+	deque.clear()
+	deque.pushBack(actions, depth)
+}
+
+func (deque *stepDeque) clear() {
+	for deque.size > 0 {
+		deque.popFront()
+	}
+	deque.head = 0
+}
+
+func (deque *stepDeque) actions() []Action {
+	actions := make([]Action, deque.size)
+	for index := range actions {
+		actions[index] = deque.at(index).action
+	}
+	return actions
+}
+
+func (deque *stepDeque) grow(extra int) {
+	needed := deque.size + extra
+	if needed <= len(deque.items) {
+		return
+	}
+
+	capacity := len(deque.items) * 2
+	if capacity < minDequeCapacity {
+		capacity = minDequeCapacity
+	}
+	for capacity < needed {
+		capacity *= 2
+	}
+
+	items := make([]queueStep, capacity)
+	for index := 0; index < deque.size; index++ {
+		items[index] = deque.at(index)
+	}
+	deque.items = items
+	deque.head = 0
+}
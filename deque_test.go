@@ -0,0 +1,138 @@
+package queuerunner
+
+import (
+	"sync"
+	"testing"
+)
+
+func namedActions(names ...string) []Action {
+	actions := make([]Action, len(names))
+	for index, name := range names {
+		actions[index] = Label(name, anyAction(func(_ *Context) error { return nil }))
+	}
+	return actions
+}
+
+func dequeLabels(deque *stepDeque) []string {
+	labels := []string{}
+	for _, action := range deque.actions() {
+		labels = append(labels, LabelOf(action))
+	}
+	return labels
+}
+
+func expectLabels(t *testing.T, deque *stepDeque, expected ...string) {
+	t.Helper()
+	labels := dequeLabels(deque)
+	if len(labels) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, labels)
+	}
+	for i := range expected {
+		if labels[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, labels)
+		}
+	}
+}
+
+func TestStepDequeOrder(t *testing.T) {
+	deque := newStepDeque(namedActions("c", "d"))
+	deque.pushFront(namedActions("a", "b"), 1)
+	deque.pushBack(namedActions("e"), 1)
+	expectLabels(t, deque, "a", "b", "c", "d", "e")
+
+	deque.insert(1, namedActions("x"), 1)
+	deque.insert(5, namedActions("y"), 1)
+	expectLabels(t, deque, "a", "x", "b", "c", "d", "y", "e")
+
+	step, _ := deque.popFront()
+	if LabelOf(step.action) != "a" {
+		t.Fatalf("expected a, got %q", LabelOf(step.action))
+	}
+	deque.dropFront(2)
+	expectLabels(t, deque, "c", "d", "y", "e")
+
+	deque.clear()
+	if _, ok := deque.popFront(); ok || deque.Len() != 0 {
+		t.Fatal("expected deque to be empty")
+	}
+}
+
+func TestStepDequeWrapsAround(t *testing.T) {
+	deque := newStepDeque(nil)
+	for round := 0; round < 40; round++ {
+		deque.pushBack(namedActions("tail"), 0)
+		deque.pushFront(namedActions("head"), 0)
+		deque.popFront()
+	}
+	if deque.Len() != 40 {
+		t.Fatalf("expected 40 steps, got %d", deque.Len())
+	}
+	for index := 0; index < deque.Len(); index++ {
+		if LabelOf(deque.at(index).action) != "tail" {
+			t.Fatalf("unexpected step at %d", index)
+		}
+	}
+}
+
+func TestPushDoesNotAliasBranchSlices(t *testing.T) {
+	then := make([]Action, 1, 8)
+	then[0] = anyAction(func(_ *Context) error { return nil })
+	branch := Util.If(func(_ *Context) (bool, error) { return true, nil }, Branches{Then: then})
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for run := 0; run < 50; run++ {
+				NewQueue(QueueOpts{
+					Actions: []Action{branch, branch, Util.Delay(0)},
+					Name:    "TestQueue",
+					Logger:  &testLogger{},
+				}).Run(map[string]any{})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(then) != 1 || then[:cap(then)][1] != nil {
+		t.Fatal("expected branch slice to stay untouched")
+	}
+}
+
+func BenchmarkQueuePushNested(b *testing.B) {
+	noop := anyAction(func(_ *Context) error { return nil })
+	tail := make([]Action, 100)
+	for index := range tail {
+		tail[index] = noop
+	}
+
+	for i := 0; i < b.N; i++ {
+		depth := 0
+		var nested Action
+		nested = anyAction(func(ctx *Context) error {
+			depth++
+			if depth < 1000 {
+				ctx.Push([]Action{noop, nested})
+			}
+			return nil
+		})
+
+		NewQueue(QueueOpts{
+			Actions: append([]Action{nested}, tail...),
+			Name:    "BenchQueue",
+			Logger:  &testLogger{},
+		}).Run(map[string]any{})
+	}
+}
+
+func BenchmarkStepDequePushPop(b *testing.B) {
+	deque := newStepDeque(nil)
+	actions := []Action{anyAction(func(_ *Context) error { return nil })}
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		deque.pushFront(actions, 1)
+		deque.popFront()
+	}
+}
@@ -0,0 +1,49 @@
+package queuerunner
+
+import "reflect"
+
+type actionInfo struct {
+	meta     Meta
+	origin   Action
+	label    string
+	contract *Contract
+	branches [][]Action
+}
+
+// wrapAction builds an action that runs run and still reports what inner
+// declares, so metadata survives WithLock, WithDelay and similar wrappers.
+// It must not be inlined: describeAction recognizes wrapped actions by the
+// code pointer of the closure below.
+//
+//go:noinline
+func wrapAction(inner Action, run Action, decorate func(info *actionInfo)) Action {
+	return func(ctx *Context) error {
+		if ctx != nil && ctx.probe != nil {
+			*ctx.probe = describeAction(inner)
+			if ctx.probe.origin == nil {
+				ctx.probe.origin = inner
+			}
+			if decorate != nil {
+				decorate(ctx.probe)
+			}
+			return nil
+		}
+		return run(ctx)
+	}
+}
+
+var wrappedActionPC uintptr
+
+func init() {
+	wrappedActionPC = reflect.ValueOf(wrapAction(nil, nil, nil)).Pointer()
+}
+
+func describeAction(action Action) actionInfo {
+	if action == nil || reflect.ValueOf(action).Pointer() != wrappedActionPC {
+		return actionInfo{}
+	}
+
+	info := actionInfo{}
+	_ = action(&Context{probe: &info})
+	return info
+}
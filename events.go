@@ -0,0 +1,201 @@
+package queuerunner
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultEventBuffer = 64
+
+type EventInfo struct {
+	Queue string
+	Time  time.Time
+}
+
+func (info EventInfo) eventInfo() EventInfo {
+	return info
+}
+
+type Event interface {
+	eventInfo() EventInfo
+}
+
+type QueueStarted struct {
+	EventInfo
+}
+
+type ActionStarted struct {
+	EventInfo
+	Action Meta
+}
+
+type ActionSucceeded struct {
+	EventInfo
+	Action   Meta
+	Duration time.Duration
+}
+
+type ActionFailed struct {
+	EventInfo
+	Action   Meta
+	Err      error
+	Duration time.Duration
+}
+
+type ActionPanicked struct {
+	EventInfo
+	Action Meta
+	Value  any
+}
+
+type Pushed struct {
+	EventInfo
+	Actions []string
+}
+
+type Aborted struct {
+	EventInfo
+}
+
+type QueueEnded struct {
+	EventInfo
+	Result RunResult
+}
+
+type LockWaiting struct {
+	EventInfo
+	Scope string
+}
+
+type LockAcquired struct {
+	EventInfo
+	Scope string
+}
+
+type LockReleased struct {
+	EventInfo
+	Scope string
+}
+
+type LockDeadlock struct {
+	EventInfo
+	Scopes []string
+	Cycle  []string
+}
+
+type LockExpired struct {
+	EventInfo
+	Scope string
+	Token uint64
+}
+
+type Subscription struct {
+	Events  <-chan Event
+	events  chan Event
+	dropped uint64
+	bus     *eventBus
+}
+
+func (subscription *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&subscription.dropped)
+}
+
+func (subscription *Subscription) Unsubscribe() {
+	subscription.bus.unsubscribe(subscription)
+}
+
+// eventBus fans events out to subscriptions without ever blocking the
+// publisher. A subscription whose buffer is full loses the event and counts
+// it as dropped.
+type eventBus struct {
+	mu            sync.RWMutex
+	subscriptions []*Subscription
+	active        int32
+}
+
+func (bus *eventBus) subscribe(buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = DefaultEventBuffer
+	}
+
+	events := make(chan Event, buffer)
+	subscription := &Subscription{Events: events, events: events, bus: bus}
+
+	bus.mu.Lock()
+	bus.subscriptions = append(bus.subscriptions, subscription)
+	atomic.StoreInt32(&bus.active, int32(len(bus.subscriptions)))
+	bus.mu.Unlock()
+
+	return subscription
+}
+
+func (bus *eventBus) unsubscribe(subscription *Subscription) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	for index, current := range bus.subscriptions {
+		if current != subscription {
+			continue
+		}
+		bus.subscriptions = append(bus.subscriptions[:index:index], bus.subscriptions[index+1:]...)
+		atomic.StoreInt32(&bus.active, int32(len(bus.subscriptions)))
+		close(subscription.events)
+		return
+	}
+}
+
+func (bus *eventBus) observed() bool {
+	return bus != nil && atomic.LoadInt32(&bus.active) > 0
+}
+
+func (bus *eventBus) publish(event Event) {
+	if !bus.observed() {
+		return
+	}
+
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+
+	for _, subscription := range bus.subscriptions {
+		select {
+		case subscription.events <- event:
+		default:
+			atomic.AddUint64(&subscription.dropped, 1)
+		}
+	}
+}
+
+func (queue *Queue) Subscribe(buffer int) *Subscription {
+	return queue.events.subscribe(buffer)
+}
+
+func (queue *Queue) observed() bool {
+	return queue.events.observed() || queue.runnerBus.observed()
+}
+
+func (queue *Queue) publish(event Event) {
+	queue.events.publish(event)
+	queue.runnerBus.publish(event)
+}
+
+func (queue *Queue) eventInfo() EventInfo {
+	return EventInfo{Queue: queue.name, Time: time.Now()}
+}
+
+func (queue *Queue) emit(build func(info EventInfo) Event) {
+	if !queue.observed() {
+		return
+	}
+	queue.publish(build(queue.eventInfo()))
+}
+
+func (queue *Queue) emitPushed(actions []Action) {
+	queue.emit(func(info EventInfo) Event {
+		names := make([]string, len(actions))
+		for index, action := range actions {
+			names[index] = actionName(action)
+		}
+		return Pushed{EventInfo: info, Actions: names}
+	})
+}
@@ -0,0 +1,140 @@
+package queuerunner
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func collectEvents(subscription *Subscription) []Event {
+	events := []Event{}
+	for {
+		select {
+		case event := <-subscription.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func eventKinds(events []Event) []string {
+	kinds := make([]string, len(events))
+	for index, event := range events {
+		kinds[index] = fmt.Sprintf("%T", event)
+	}
+	return kinds
+}
+
+func TestQueueEventsLifecycle(t *testing.T) {
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			Named("push", func(ctx *Context) error {
+				ctx.Push([]Action{WithLock("browser", Named("locked", func(_ *Context) error { return nil }))})
+				return nil
+			}),
+			Named("fail", func(_ *Context) error { return ErrInvalidScope }),
+			Named("never", func(_ *Context) error { return nil }),
+		},
+		Name:   "TestQueue",
+		Logger: &testLogger{},
+	})
+	subscription := queue.Subscribe(64)
+
+	queue.Run(map[string]any{})
+
+	expected := []string{
+		"queuerunner.QueueStarted",
+		"queuerunner.ActionStarted", "queuerunner.Pushed", "queuerunner.ActionSucceeded",
+		"queuerunner.ActionStarted", "queuerunner.LockAcquired", "queuerunner.LockReleased", "queuerunner.ActionSucceeded",
+		"queuerunner.ActionStarted", "queuerunner.ActionFailed", "queuerunner.Aborted",
+		"queuerunner.QueueEnded",
+	}
+	events := collectEvents(subscription)
+	kinds := eventKinds(events)
+	if len(kinds) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, kinds)
+	}
+	for i := range expected {
+		if kinds[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, kinds)
+		}
+	}
+
+	failed := events[9].(ActionFailed)
+	if failed.Action.Name != "fail" || !errors.Is(failed.Err, ErrInvalidScope) || failed.Queue != "TestQueue" {
+		t.Fatalf("unexpected failure event: %+v", failed)
+	}
+	ended := events[len(events)-1].(QueueEnded)
+	if !ended.Result.Aborted || !errors.Is(ended.Result.Err, ErrInvalidScope) {
+		t.Fatalf("unexpected end event: %+v", ended)
+	}
+}
+
+func TestQueueEventsPanicAndLockWaiting(t *testing.T) {
+	locking := NewLockManager()
+	if err := locking.Lock("browser"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		locking.Unlock("browser")
+	}()
+
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			WithLock("browser", func(_ *Context) error { return nil }),
+			func(_ *Context) error { panic("boom") },
+		},
+		Name:           "TestQueue",
+		Logger:         &testLogger{},
+		LockingContext: locking,
+	})
+	subscription := queue.Subscribe(64)
+
+	queue.Run(map[string]any{})
+
+	var waiting, panicked bool
+	for _, event := range collectEvents(subscription) {
+		switch event := event.(type) {
+		case LockWaiting:
+			waiting = event.Scope == "browser"
+		case ActionPanicked:
+			panicked = event.Value == "boom"
+		}
+	}
+	if !waiting || !panicked {
+		t.Fatalf("expected lock waiting and panic events, got waiting=%v panicked=%v", waiting, panicked)
+	}
+}
+
+func TestSlowSubscriberDoesNotBlock(t *testing.T) {
+	done := make(chan struct{})
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}})
+	slow := runner.Subscribe(1)
+	runner.AddEndListener(func(_ string, size int) {
+		if size == 0 {
+			close(done)
+		}
+	})
+
+	actions := []Action{}
+	for index := 0; index < 20; index++ {
+		actions = append(actions, Util.Delay(0))
+	}
+	runner.Add(actions, map[string]any{}, "")
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("slow subscriber stalled the queue")
+	}
+
+	if slow.Dropped() == 0 {
+		t.Fatal("expected events to be dropped for the slow subscriber")
+	}
+	slow.Unsubscribe()
+	for range slow.Events {
+	}
+}
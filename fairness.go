@@ -0,0 +1,144 @@
+package queuerunner
+
+import (
+	"context"
+	"time"
+)
+
+type lockPriorityKey struct{}
+
+// ContextWithLockPriority returns a context whose lock requests are served
+// before lower-priority ones waiting on the same scope. Requests of equal
+// priority are served in arrival order. The default priority is 0.
+func ContextWithLockPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, lockPriorityKey{}, priority)
+}
+
+func lockPriority(ctx context.Context) int {
+	priority, _ := ctx.Value(lockPriorityKey{}).(int)
+	return priority
+}
+
+type lockWaiter struct {
+	mode     lockMode
+	capacity int
+	priority int
+	owner    *LockOwner
+	action   string
+	since    time.Time
+	scopes   []*lockScope
+	holds    []*lockHold
+	ready    chan struct{}
+	granted  bool
+}
+
+// acquireFair queues the request behind everything of equal or higher
+// priority and waits for a release to hand the scopes over. The handoff
+// takes the scopes on the waiter's behalf, so nobody can barge in between.
+// A request for several scopes joins every queue at once; since all queues
+// follow the same priority and arrival order, two such requests can never
+// wait on each other in a cycle.
+func (manager *LockManager) acquireFair(ctx context.Context, waiter *lockWaiter) ([]*lockHold, error) {
+	waiter.priority = lockPriority(ctx)
+	waiter.ready = make(chan struct{})
+	for _, state := range waiter.scopes {
+		state.enqueue(waiter)
+	}
+	for _, state := range waiter.scopes {
+		state.grant()
+	}
+	if waiter.granted {
+		return waiter.holds, nil
+	}
+
+	manager.waiters[waiter] = struct{}{}
+	defer delete(manager.waiters, waiter)
+	if err := manager.detectDeadlock(waiter); err != nil {
+		manager.abandon(waiter)
+		return nil, err
+	}
+
+	manager.mu.Unlock()
+	beforeLockWait(ctx)
+	select {
+	case <-waiter.ready:
+		manager.mu.Lock()
+		return waiter.holds, nil
+	case <-ctx.Done():
+		manager.mu.Lock()
+	}
+
+	if waiter.granted {
+		return waiter.holds, nil
+	}
+	manager.abandon(waiter)
+	return nil, ctx.Err()
+}
+
+// abandon takes a queued waiter out of every queue it joined and lets the
+// requests behind it move up.
+func (manager *LockManager) abandon(waiter *lockWaiter) {
+	for _, state := range waiter.scopes {
+		state.dequeue(waiter)
+	}
+	for _, state := range waiter.scopes {
+		manager.notify(state)
+	}
+}
+
+func (state *lockScope) enqueue(waiter *lockWaiter) {
+	index := len(state.queue)
+	for index > 0 && state.queue[index-1].priority < waiter.priority {
+		index--
+	}
+	state.queue = append(state.queue, nil)
+	copy(state.queue[index+1:], state.queue[index:])
+	state.queue[index] = waiter
+	state.wait(waiter.mode, 1)
+}
+
+func (state *lockScope) dequeue(waiter *lockWaiter) {
+	for index, current := range state.queue {
+		if current == waiter {
+			state.queue = append(state.queue[:index], state.queue[index+1:]...)
+			state.wait(waiter.mode, -1)
+			return
+		}
+	}
+}
+
+// grant hands the scope to waiters from the head of the queue for as long
+// as they fit, so a release can admit a whole run of readers at once. It
+// stops at the first waiter that does not fit, which keeps later requests
+// from overtaking it.
+func (state *lockScope) grant() {
+	for len(state.queue) > 0 {
+		waiter := state.queue[0]
+		if !waiter.admissible() {
+			return
+		}
+		waiter.admit()
+	}
+}
+
+// admissible reports whether the waiter heads the queue of every scope it
+// asked for and fits into all of them.
+func (waiter *lockWaiter) admissible() bool {
+	for _, state := range waiter.scopes {
+		if state.queue[0] != waiter || !state.compatible(waiter.mode, waiter.capacity) {
+			return false
+		}
+	}
+	return true
+}
+
+func (waiter *lockWaiter) admit() {
+	for _, state := range waiter.scopes {
+		state.queue[0] = nil
+		state.queue = state.queue[1:]
+		state.wait(waiter.mode, -1)
+		waiter.holds = append(waiter.holds, state.take(waiter.mode, waiter.capacity, waiter.owner, waiter.action))
+	}
+	waiter.granted = true
+	close(waiter.ready)
+}
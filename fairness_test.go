@@ -0,0 +1,269 @@
+package queuerunner
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitQueued(t *testing.T, manager *LockManager, scope string, count int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		manager.mu.Lock()
+		state, ok := manager.scopes[scope]
+		queued := 0
+		if ok {
+			queued = len(state.queue)
+		}
+		manager.mu.Unlock()
+		if queued == count {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d queued requests for %q", count, scope)
+}
+
+type orderRecorder struct {
+	mu    sync.Mutex
+	order []string
+}
+
+func (recorder *orderRecorder) record(name string) func() error {
+	return func() error {
+		recorder.mu.Lock()
+		recorder.order = append(recorder.order, name)
+		recorder.mu.Unlock()
+		return nil
+	}
+}
+
+func (recorder *orderRecorder) expect(t *testing.T, expected ...string) {
+	t.Helper()
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.order) != len(expected) {
+		t.Fatalf("unexpected order: %v", recorder.order)
+	}
+	for index := range expected {
+		if recorder.order[index] != expected[index] {
+			t.Fatalf("unexpected order: %v", recorder.order)
+		}
+	}
+}
+
+func TestLockManagerHandsOffInArrivalOrder(t *testing.T) {
+	manager := NewLockManager()
+	if err := manager.Lock("db"); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &orderRecorder{}
+	var wg sync.WaitGroup
+	names := []string{"a", "b", "c", "d", "e"}
+	for index, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			_ = manager.RunWithLock("db", recorder.record(name))
+		}(name)
+		waitQueued(t, manager, "db", index+1)
+	}
+
+	manager.Unlock("db")
+	wg.Wait()
+	recorder.expect(t, names...)
+}
+
+func TestLockManagerServesHigherPriorityFirst(t *testing.T) {
+	manager := NewLockManager()
+	if err := manager.Lock("db"); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &orderRecorder{}
+	var wg sync.WaitGroup
+	requests := []struct {
+		name     string
+		priority int
+	}{{"low", 0}, {"low-2", 0}, {"high", 10}, {"mid", 5}}
+	for index, request := range requests {
+		wg.Add(1)
+		go func(name string, priority int) {
+			defer wg.Done()
+			ctx := ContextWithLockPriority(context.Background(), priority)
+			_ = manager.RunWithLockContext(ctx, "db", recorder.record(name))
+		}(request.name, request.priority)
+		waitQueued(t, manager, "db", index+1)
+	}
+
+	manager.Unlock("db")
+	wg.Wait()
+	recorder.expect(t, "high", "mid", "low", "low-2")
+}
+
+func TestLockManagerHandsOffToRunOfReaders(t *testing.T) {
+	manager := NewLockManager()
+	if err := manager.Lock("db"); err != nil {
+		t.Fatal(err)
+	}
+
+	var readers int32
+	inside := make(chan struct{})
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	read := func() {
+		defer wg.Done()
+		_ = manager.RunWithRLock("db", func() error {
+			if atomic.AddInt32(&readers, 1) == 2 {
+				close(inside)
+			}
+			<-release
+			return nil
+		})
+	}
+
+	wg.Add(3)
+	go read()
+	waitQueued(t, manager, "db", 1)
+	go read()
+	waitQueued(t, manager, "db", 2)
+	written := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		_ = manager.RunWithLock("db", func() error {
+			close(written)
+			return nil
+		})
+	}()
+	waitQueued(t, manager, "db", 3)
+
+	manager.Unlock("db")
+	select {
+	case <-inside:
+	case <-time.After(time.Second):
+		t.Fatal("expected both queued readers to be admitted together")
+	}
+	if err := manager.RLock("db"); err == nil {
+		t.Fatal("expected a new reader to queue behind the waiting writer")
+	}
+
+	close(release)
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("writer did not get the scope after readers finished")
+	}
+	wg.Wait()
+}
+
+func TestLockManagerCancelledHeadUnblocksQueue(t *testing.T) {
+	manager := NewLockManager()
+	if err := manager.RLock("db"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := make(chan error, 1)
+	go func() { writer <- manager.LockContext(ctx, "db") }()
+	waitQueued(t, manager, "db", 1)
+
+	reader := make(chan error, 1)
+	go func() { reader <- manager.RLockContext(context.Background(), "db") }()
+	waitQueued(t, manager, "db", 2)
+
+	cancel()
+	if err := <-writer; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancelled writer, got %v", err)
+	}
+	select {
+	case err := <-reader:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reader stayed queued behind a cancelled writer")
+	}
+}
+
+// TestLockManagerIsStarvationFree keeps a scope under constant contention and
+// checks that a late request is served after at most one turn of every
+// request that was already waiting.
+func TestLockManagerIsStarvationFree(t *testing.T) {
+	const hammers = 4
+	manager := NewLockManager()
+	var turns int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for index := 0; index < hammers; index++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_ = manager.RunWithLock("db", func() error {
+					atomic.AddInt64(&turns, 1)
+					return nil
+				})
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	for round := 0; round < 50; round++ {
+		before := atomic.LoadInt64(&turns)
+		var during int64
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := manager.RunWithLockContext(ctx, "db", func() error {
+			during = atomic.LoadInt64(&turns) - before
+			return nil
+		})
+		cancel()
+		if err != nil {
+			t.Fatalf("round %d: late request starved: %v", round, err)
+		}
+		if during > 2*hammers {
+			t.Fatalf("round %d: %d other turns before a waiting request", round, during)
+		}
+	}
+}
+
+func TestLockManagerRacingOrdering(t *testing.T) {
+	manager := NewLockManagerWithOpts(LockManagerOpts{Ordering: LockRacing})
+	var inside, total int32
+	var wg sync.WaitGroup
+
+	for index := 0; index < 8; index++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for turn := 0; turn < 50; turn++ {
+				_ = manager.RunWithLock("db", func() error {
+					if atomic.AddInt32(&inside, 1) != 1 {
+						t.Error("two holders inside an exclusive scope")
+					}
+					atomic.AddInt32(&total, 1)
+					atomic.AddInt32(&inside, -1)
+					return nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if total != 400 || manager.IsLocked("db") || len(manager.scopes) != 0 {
+		t.Fatalf("unexpected state after racing holders: total %d", total)
+	}
+}
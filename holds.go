@@ -0,0 +1,113 @@
+package queuerunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrLockNotHeld = errors.New("lock scope is not held by the queue")
+
+var ErrDetachedContext = errors.New("context is not attached to a queue")
+
+// AcquireLock takes scope exclusively for the queue and keeps it across the
+// following actions until ReleaseLock. Whatever is still held when the
+// queue ends, fails, aborts or panics is released then. With a worker pool,
+// the queue gives up its worker while it waits.
+func (ctx *Context) AcquireLock(scope string) error {
+	if ctx == nil || ctx.acquireLockFn == nil {
+		return ErrDetachedContext
+	}
+	return ctx.acquireLockFn(scope)
+}
+
+func (ctx *Context) ReleaseLock(scope string) error {
+	if ctx == nil || ctx.releaseLockFn == nil {
+		return ErrDetachedContext
+	}
+	return ctx.releaseLockFn(scope)
+}
+
+func (queue *Queue) acquireLock(scope string) error {
+	if err := ValidateScope(scope); err != nil {
+		return err
+	}
+
+	if queue.lockManager.IsLocked(scope) {
+		queue.emit(func(info EventInfo) Event {
+			return LockWaiting{EventInfo: info, Scope: scope}
+		})
+	}
+	var err error
+	func() {
+		lockCtx, rejoin := queue.context.waitingLockContext(queue.lockManager)
+		defer rejoin()
+		err = lockWithContext(lockCtx, queue.lockManager, scope)
+	}()
+	if err != nil {
+		var deadlock *DeadlockError
+		if errors.As(err, &deadlock) {
+			queue.emit(func(info EventInfo) Event {
+				return LockDeadlock{EventInfo: info, Scopes: deadlock.Scopes, Cycle: deadlock.Cycle}
+			})
+		}
+		return err
+	}
+
+	queue.held = append(queue.held, scope)
+	queue.emit(func(info EventInfo) Event {
+		return LockAcquired{EventInfo: info, Scope: scope}
+	})
+	return nil
+}
+
+func (queue *Queue) releaseLock(scope string) error {
+	for index := len(queue.held) - 1; index >= 0; index-- {
+		if queue.held[index] != scope {
+			continue
+		}
+		queue.held = append(queue.held[:index], queue.held[index+1:]...)
+		queue.unlock(scope)
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrLockNotHeld, scope)
+}
+
+// releaseLocks gives up every scope the queue still holds, newest first.
+func (queue *Queue) releaseLocks() {
+	for index := len(queue.held) - 1; index >= 0; index-- {
+		queue.unlock(queue.held[index])
+	}
+	queue.held = nil
+}
+
+func (queue *Queue) unlock(scope string) {
+	queue.lockManager.Unlock(scope)
+	queue.emit(func(info EventInfo) Event {
+		return LockReleased{EventInfo: info, Scope: scope}
+	})
+}
+
+type contextLocker interface {
+	LockContext(ctx context.Context, scope string) error
+}
+
+// lockWithContext takes scope exclusively without a function to run under
+// it, polling Lock on locking contexts that cannot wait for it themselves.
+func lockWithContext(ctx context.Context, locking LockingContext, scope string) error {
+	if locker, ok := locking.(contextLocker); ok {
+		return locker.LockContext(ctx, scope)
+	}
+
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for locking.Lock(scope) != nil {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package queuerunner
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUtilLockedHoldsScopeAcrossActions(t *testing.T) {
+	locking := NewLockManager()
+	held := []bool{}
+	check := func(_ *Context) error {
+		held = append(held, locking.IsLocked("db"))
+		return nil
+	}
+
+	queue := NewQueue(QueueOpts{
+		Actions:        []Action{Util.Locked("db", []Action{check, check, check}), check},
+		Logger:         &testLogger{},
+		LockingContext: locking,
+	})
+	if result := queue.Run(map[string]any{}); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	if len(held) != 4 || !held[0] || !held[1] || !held[2] || held[3] {
+		t.Fatalf("expected the scope to be held for the block only, got %v", held)
+	}
+	if name := actionName(Util.Locked("db", nil)); name != "Util.Locked(db)" {
+		t.Fatalf("unexpected name %q", name)
+	}
+}
+
+func TestQueueReleasesHeldLocksWhenItStops(t *testing.T) {
+	cases := map[string]Action{
+		"end":   func(_ *Context) error { return nil },
+		"error": func(_ *Context) error { return errors.New("boom") },
+		"abort": Util.Abort,
+		"panic": func(_ *Context) error { panic("boom") },
+	}
+
+	for name, last := range cases {
+		locking := NewLockManager()
+		queue := NewQueue(QueueOpts{
+			Actions: []Action{
+				func(ctx *Context) error { return ctx.AcquireLock("db") },
+				func(ctx *Context) error { return ctx.AcquireLock("cache") },
+				last,
+			},
+			Logger:         &testLogger{},
+			LockingContext: locking,
+		})
+		queue.Run(map[string]any{})
+
+		if locking.IsLocked("db") || locking.IsLocked("cache") {
+			t.Fatalf("%s: expected held scopes to be released", name)
+		}
+	}
+}
+
+func TestReleaseLock(t *testing.T) {
+	locking := NewLockManager()
+	var releaseErr, missingErr error
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			func(ctx *Context) error { return ctx.AcquireLock("db") },
+			func(ctx *Context) error {
+				releaseErr = ctx.ReleaseLock("db")
+				missingErr = ctx.ReleaseLock("db")
+				return nil
+			},
+		},
+		Logger:         &testLogger{},
+		LockingContext: locking,
+	})
+	queue.Run(map[string]any{})
+
+	if releaseErr != nil || !errors.Is(missingErr, ErrLockNotHeld) {
+		t.Fatalf("unexpected release errors: %v, %v", releaseErr, missingErr)
+	}
+	if err := (&Context{}).AcquireLock("db"); !errors.Is(err, ErrDetachedContext) {
+		t.Fatalf("expected ErrDetachedContext, got %v", err)
+	}
+}
+
+func TestPoolRunnerLockedBlockDoesNotHoldWorker(t *testing.T) {
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}, Workers: 1})
+	release := make(chan struct{})
+	recorder := &orderRecorder{}
+	block := func(name string) []Action {
+		return []Action{Util.Locked("browser", []Action{
+			func(_ *Context) error { return recorder.record(name)() },
+			Util.Delay(20 * time.Millisecond),
+		})}
+	}
+
+	runner.Add(block("holder"), map[string]any{}, "holder")
+	runner.Add(block("waiter"), map[string]any{}, "waiter")
+	runner.Add([]Action{func(_ *Context) error {
+		close(release)
+		return recorder.record("free")()
+	}}, map[string]any{}, "free")
+
+	select {
+	case <-release:
+	case <-time.After(time.Second):
+		t.Fatal("a queue waiting in Util.Locked held the only worker")
+	}
+	waitIdle(t, runner)
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.order) != 3 || recorder.order[2] == "free" {
+		t.Fatalf("expected the free queue to run while the scope was held, got %v", recorder.order)
+	}
+}
@@ -0,0 +1,137 @@
+package queuerunner
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+type idleCallbackEntry struct {
+	id       uint64
+	callback func()
+}
+
+// track registers queue as running before it starts, so a queue added from
+// inside a running action keeps the runner busy without a gap in between.
+func (runner *QueueRunner) track(queue *Queue) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+
+	if len(runner.queues) == 0 {
+		runner.idle = make(chan struct{})
+	}
+	runner.queues[queue] = struct{}{}
+}
+
+func (runner *QueueRunner) onQueueEnd(queue *Queue) {
+	if queue.template != nil {
+		if next := queue.template.done(queue); next != nil {
+			runner.run(next.queue, next.context)
+		}
+	}
+	if queue.done != nil {
+		queue.done()
+	}
+
+	runner.mu.Lock()
+	delete(runner.queues, queue)
+	size := len(runner.queues)
+	listeners := runner.listeners
+
+	var idleCallbacks []idleCallbackEntry
+	if size == 0 && runner.idle != nil {
+		close(runner.idle)
+		runner.idle = nil
+		idleCallbacks = runner.onIdle
+	}
+	runner.mu.Unlock()
+
+	runner.notifyEnd(listeners, queue.name, size)
+	runner.notifyIdle(idleCallbacks)
+}
+
+// WaitIdle blocks until no queue is running or ctx is done. Queues waiting
+// in AddAt or AddAfter and recurring schedules are not running until they
+// start, so they do not keep the runner busy; Close drops them.
+func (runner *QueueRunner) WaitIdle(ctx context.Context) error {
+	runner.mu.Lock()
+	idle := runner.idle
+	runner.mu.Unlock()
+
+	if idle == nil {
+		return nil
+	}
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// OnIdle registers callback to run every time the last running queue ends.
+// It returns a function that removes the callback.
+func (runner *QueueRunner) OnIdle(callback func()) func() {
+	if callback == nil {
+		return func() {}
+	}
+
+	runner.mu.Lock()
+	runner.idleID++
+	id := runner.idleID
+	callbacks := make([]idleCallbackEntry, 0, len(runner.onIdle)+1)
+	callbacks = append(callbacks, runner.onIdle...)
+	runner.onIdle = append(callbacks, idleCallbackEntry{id: id, callback: callback})
+	runner.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			runner.mu.Lock()
+			defer runner.mu.Unlock()
+
+			callbacks := make([]idleCallbackEntry, 0, len(runner.onIdle))
+			for _, entry := range runner.onIdle {
+				if entry.id != id {
+					callbacks = append(callbacks, entry)
+				}
+			}
+			runner.onIdle = callbacks
+		})
+	}
+}
+
+func (runner *QueueRunner) notifyIdle(callbacks []idleCallbackEntry) {
+	if len(callbacks) == 0 {
+		return
+	}
+
+	notify := func() {
+		for _, entry := range callbacks {
+			runner.callIdleCallback(entry.callback)
+		}
+	}
+
+	if runner.dispatcher != nil {
+		runner.dispatcher.dispatch(notify)
+		return
+	}
+	notify()
+}
+
+func (runner *QueueRunner) callIdleCallback(callback func()) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logger := runner.log()
+			logger.Info("QueueRunner: idle callback failed")
+			if err, ok := recovered.(error); ok {
+				logger.Error(err)
+			} else {
+				logger.Error(fmt.Errorf("%v", recovered))
+			}
+		}
+	}()
+
+	callback()
+}
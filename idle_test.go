@@ -0,0 +1,107 @@
+package queuerunner
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitIdleCoversQueuesAddedFromActions(t *testing.T) {
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}})
+	var childDone int32
+	var idleCalls int32
+	runner.OnIdle(func() { atomic.AddInt32(&idleCalls, 1) })
+
+	if err := runner.WaitIdle(context.Background()); err != nil {
+		t.Fatalf("expected idle runner, got %v", err)
+	}
+
+	runner.Add([]Action{
+		anyAction(func(_ *Context) error {
+			runner.Add([]Action{
+				Util.Delay(20 * time.Millisecond),
+				anyAction(func(_ *Context) error {
+					atomic.StoreInt32(&childDone, 1)
+					return nil
+				}),
+			}, map[string]any{}, "child")
+			return nil
+		}),
+	}, map[string]any{}, "parent")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := runner.WaitIdle(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if atomic.LoadInt32(&childDone) != 1 {
+		t.Fatal("WaitIdle returned before the child queue finished")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if atomic.LoadInt32(&idleCalls) != 1 {
+		t.Fatalf("expected one idle callback, got %d", atomic.LoadInt32(&idleCalls))
+	}
+}
+
+func TestWaitIdleHonorsContext(t *testing.T) {
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}})
+	release := make(chan struct{})
+	defer close(release)
+
+	runner.Add([]Action{anyAction(func(_ *Context) error {
+		<-release
+		return nil
+	})}, map[string]any{}, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := runner.WaitIdle(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+}
+
+func TestWaitIdleExcludesPendingStarts(t *testing.T) {
+	clock := newTestClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}, Clock: clock})
+	release := make(chan struct{})
+	if _, err := runner.AddAfter(time.Minute, []Action{anyAction(func(_ *Context) error {
+		<-release
+		return nil
+	})}, map[string]any{}, "later"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runner.WaitIdle(context.Background()); err != nil {
+		t.Fatalf("expected a pending start not to keep the runner busy, got %v", err)
+	}
+
+	clock.Advance(time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := runner.WaitIdle(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the started queue to keep the runner busy, got %v", err)
+	}
+	close(release)
+	if err := runner.WaitIdle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEndListenerSizeWithDuplicateNames(t *testing.T) {
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}})
+	sizes := make(chan int, 2)
+	runner.AddEndListener(func(_ string, size int) { sizes <- size })
+
+	runner.Add([]Action{Util.Delay(5 * time.Millisecond)}, map[string]any{}, "same")
+	runner.Add([]Action{Util.Delay(20 * time.Millisecond)}, map[string]any{}, "same")
+
+	if first := <-sizes; first != 1 {
+		t.Fatalf("expected one queue still running, got %d", first)
+	}
+	if second := <-sizes; second != 0 {
+		t.Fatalf("expected no queues running, got %d", second)
+	}
+}
@@ -0,0 +1,138 @@
+package queuerunner
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+type lockActionKey struct{}
+
+// ContextWithLockAction names the action a lock request is made for, which
+// Snapshot and long-hold warnings report. Queues attach the running
+// action's name themselves.
+func ContextWithLockAction(ctx context.Context, action string) context.Context {
+	return context.WithValue(ctx, lockActionKey{}, action)
+}
+
+func lockActionOf(ctx context.Context) string {
+	action, _ := ctx.Value(lockActionKey{}).(string)
+	return action
+}
+
+// LockHolder describes one hold of a scope. Queue is the name of the
+// owning queue and is empty for holds taken through the plain Lock and
+// RLock methods. Count is above one for reentrant holds. Expires is set for
+// leases only.
+type LockHolder struct {
+	Queue   string
+	Action  string
+	Mode    string
+	Count   int
+	Since   time.Time
+	Expires time.Time
+}
+
+// LockRequest describes a request waiting for a scope.
+type LockRequest struct {
+	Queue  string
+	Action string
+	Mode   string
+	Since  time.Time
+}
+
+type LockSnapshot struct {
+	Scope   string
+	Holders []LockHolder
+	Waiters []LockRequest
+}
+
+// Snapshot describes every scope that is held or waited for, sorted by
+// scope. Holders are listed in the order they took the scope and waiters
+// in the order they would be served with FIFO ordering, or by arrival with
+// racing ordering.
+func (manager *LockManager) Snapshot() []LockSnapshot {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	waiting := map[*lockScope][]*lockWaiter{}
+	if !manager.fair {
+		for waiter := range manager.waiters {
+			for _, state := range waiter.scopes {
+				waiting[state] = append(waiting[state], waiter)
+			}
+		}
+	}
+
+	snapshot := make([]LockSnapshot, 0, len(manager.scopes))
+	for name, state := range manager.scopes {
+		waiters := state.queue
+		if !manager.fair {
+			waiters = waiting[state]
+			sort.SliceStable(waiters, func(i, j int) bool { return waiters[i].since.Before(waiters[j].since) })
+		}
+
+		entry := LockSnapshot{Scope: name}
+		for _, hold := range state.holds {
+			entry.Holders = append(entry.Holders, hold.holder())
+		}
+		for _, waiter := range waiters {
+			entry.Waiters = append(entry.Waiters, LockRequest{
+				Queue:  ownerName(waiter.owner),
+				Action: waiter.action,
+				Mode:   waiter.mode.String(),
+				Since:  waiter.since,
+			})
+		}
+		snapshot = append(snapshot, entry)
+	}
+
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].Scope < snapshot[j].Scope })
+	return snapshot
+}
+
+func (hold *lockHold) holder() LockHolder {
+	holder := LockHolder{
+		Queue:  ownerName(hold.owner),
+		Action: hold.action,
+		Mode:   hold.mode.String(),
+		Count:  hold.count,
+		Since:  hold.since,
+	}
+	if hold.lease != nil {
+		holder.Expires = hold.lease.expires
+	}
+	return holder
+}
+
+// warn reports a hold that outlasted the long-hold threshold, unless it was
+// released in the meantime. The report is made outside the manager's lock,
+// so OnLongHold may query the manager.
+func (manager *LockManager) warn(hold *lockHold) {
+	manager.mu.Lock()
+	if hold.count == 0 {
+		manager.mu.Unlock()
+		return
+	}
+	scope, holder := hold.scope.name, hold.holder()
+	manager.mu.Unlock()
+
+	if manager.onLongHold != nil {
+		manager.onLongHold(scope, holder)
+		return
+	}
+
+	message := fmt.Sprintf("LockManager: scope %q held by %s (%s) for %v", scope, displayName(holder.Queue), holder.Mode, manager.clock.Now().Sub(holder.Since))
+	if holder.Action != "" {
+		message += " in " + holder.Action
+	}
+	manager.logger.Info(message)
+}
+
+func ownerName(owner *LockOwner) string {
+	if owner == nil {
+		return ""
+	}
+	return owner.Name
+}
@@ -0,0 +1,120 @@
+package queuerunner
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockManagerSnapshot(t *testing.T) {
+	clock := newTestClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	manager := NewLockManagerWithOpts(LockManagerOpts{Clock: clock})
+	holder := ContextWithLockAction(ContextWithLockOwner(context.Background(), NewLockOwner("import")), "load")
+	waiter := ContextWithLockAction(ContextWithLockOwner(context.Background(), NewLockOwner("report")), "read")
+
+	if err := manager.LockContext(holder, "db"); err != nil {
+		t.Fatal(err)
+	}
+	acquired := clock.Now()
+	clock.Jump(time.Second)
+
+	waiting := make(chan error, 1)
+	go func() { waiting <- manager.RLockContext(waiter, "db") }()
+	deadline := time.Now().Add(time.Second)
+	for len(manager.Snapshot()[0].Waiters) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	snapshot := manager.Snapshot()
+	if len(snapshot) != 1 || snapshot[0].Scope != "db" {
+		t.Fatalf("unexpected snapshot %+v", snapshot)
+	}
+	expectedHolder := LockHolder{Queue: "import", Action: "load", Mode: "exclusive", Count: 1, Since: acquired}
+	if len(snapshot[0].Holders) != 1 || snapshot[0].Holders[0] != expectedHolder {
+		t.Fatalf("unexpected holders %+v", snapshot[0].Holders)
+	}
+	expectedWaiter := LockRequest{Queue: "report", Action: "read", Mode: "shared", Since: acquired.Add(time.Second)}
+	if len(snapshot[0].Waiters) != 1 || snapshot[0].Waiters[0] != expectedWaiter {
+		t.Fatalf("unexpected waiters %+v", snapshot[0].Waiters)
+	}
+
+	manager.Unlock("db")
+	if err := <-waiting; err != nil {
+		t.Fatal(err)
+	}
+	manager.RUnlock("db")
+	if snapshot := manager.Snapshot(); len(snapshot) != 0 {
+		t.Fatalf("expected an empty snapshot, got %+v", snapshot)
+	}
+}
+
+func TestSnapshotNamesQueueAndAction(t *testing.T) {
+	locking := NewLockManager()
+	var snapshot []LockSnapshot
+	inspect := func(_ *Context) error {
+		snapshot = locking.Snapshot()
+		return nil
+	}
+
+	queue := NewQueue(QueueOpts{
+		Name:           "billing",
+		Actions:        []Action{Named("charge", WithLock("payments", inspect))},
+		Logger:         &testLogger{},
+		LockingContext: locking,
+	})
+	if result := queue.Run(map[string]any{}); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	if len(snapshot) != 1 || len(snapshot[0].Holders) != 1 {
+		t.Fatalf("unexpected snapshot %+v", snapshot)
+	}
+	if holder := snapshot[0].Holders[0]; holder.Queue != "billing" || holder.Action != "charge" {
+		t.Fatalf("unexpected holder %+v", holder)
+	}
+}
+
+func TestLockManagerWarnsAboutLongHolds(t *testing.T) {
+	clock := newTestClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	var warned []string
+	manager := NewLockManagerWithOpts(LockManagerOpts{
+		Clock:    clock,
+		LongHold: time.Minute,
+		OnLongHold: func(scope string, holder LockHolder) {
+			warned = append(warned, scope+":"+holder.Queue)
+		},
+	})
+	owner := ContextWithLockOwner(context.Background(), NewLockOwner("import"))
+
+	if err := manager.LockContext(owner, "db"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.LockContext(owner, "cache"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(30 * time.Second)
+	manager.Unlock("cache")
+	clock.Advance(time.Hour)
+
+	if strings.Join(warned, ",") != "db:import" {
+		t.Fatalf("expected one warning for db, got %v", warned)
+	}
+}
+
+func TestLongHoldWarningIsLogged(t *testing.T) {
+	clock := newTestClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	logger := &testLogger{}
+	manager := NewLockManagerWithOpts(LockManagerOpts{Clock: clock, LongHold: time.Minute, Logger: logger})
+	ctx := ContextWithLockAction(ContextWithLockOwner(context.Background(), NewLockOwner("import")), "load")
+
+	if err := manager.LockContext(ctx, "db"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Minute)
+
+	expected := `LockManager: scope "db" held by import (exclusive) for 1m0s in load`
+	if len(logger.infos) != 1 || logger.infos[0] != expected {
+		t.Fatalf("unexpected log %v", logger.infos)
+	}
+}
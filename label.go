@@ -0,0 +1,93 @@
+package queuerunner
+
+import (
+	"errors"
+	"fmt"
+)
+
+const DefaultMaxJumps = 100
+
+var (
+	ErrLabelNotFound = errors.New("label not found in queue")
+	ErrJumpLimit     = errors.New("queue exceeded jump limit")
+)
+
+func Label(label string, action Action) Action {
+	return wrapAction(action, func(ctx *Context) error {
+		return action(ctx)
+	}, func(info *actionInfo) {
+		info.label = label
+	})
+}
+
+func LabelOf(action Action) string {
+	return describeAction(action).label
+}
+
+func (queue *Queue) GoTo(label string) error {
+	index := indexOfLabel(queue.actions, label)
+	if index < 0 {
+		return fmt.Errorf("%w: %q", ErrLabelNotFound, label)
+	}
+	if err := queue.jump(); err != nil {
+		return err
+	}
+
+	queue.queue.reset(queue.actions[index:], 0)
+	return nil
+}
+
+func (queue *Queue) SkipUntil(label string) error {
+	index := queue.indexOfRemaining(label)
+	if index < 0 {
+		return fmt.Errorf("%w: %q", ErrLabelNotFound, label)
+	}
+
+	queue.queue.dropFront(index)
+	return nil
+}
+
+func (queue *Queue) Restart() error {
+	if err := queue.jump(); err != nil {
+		return err
+	}
+
+	queue.queue.reset(queue.actions, 0)
+	return nil
+}
+
+// jump counts backward and forward jumps and aborts the queue once it
+// exceeds maxJumps, so a condition that always jumps cannot spin forever.
+func (queue *Queue) jump() error {
+	queue.jumps++
+	if queue.jumps <= queue.maxJumps {
+		return nil
+	}
+
+	queue.Abort()
+	return fmt.Errorf("%w: %d jumps", ErrJumpLimit, queue.maxJumps)
+}
+
+func indexOfLabel(actions []Action, label string) int {
+	if label == "" {
+		return -1
+	}
+	for index, action := range actions {
+		if LabelOf(action) == label {
+			return index
+		}
+	}
+	return -1
+}
+
+func (queue *Queue) indexOfRemaining(label string) int {
+	if label == "" {
+		return -1
+	}
+	for index := 0; index < queue.queue.Len(); index++ {
+		if LabelOf(queue.queue.at(index).action) == label {
+			return index
+		}
+	}
+	return -1
+}
@@ -0,0 +1,97 @@
+package queuerunner
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestContextGoToJumpsBackAndForth(t *testing.T) {
+	order := []string{}
+	attempts := 0
+
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			Label("fetch", anyAction(func(_ *Context) error {
+				attempts++
+				order = append(order, "fetch")
+				return nil
+			})),
+			anyAction(func(ctx *Context) error {
+				if attempts < 2 {
+					return ctx.GoTo("fetch")
+				}
+				return ctx.GoTo("publish")
+			}),
+			anyAction(func(_ *Context) error { order = append(order, "skipped"); return nil }),
+			Label("publish", anyAction(func(_ *Context) error { order = append(order, "publish"); return nil })),
+		},
+		Name:   "TestQueue",
+		Logger: &testLogger{},
+	})
+
+	queue.Run(map[string]any{})
+
+	expected := []string{"fetch", "fetch", "publish"}
+	if len(order) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, order)
+		}
+	}
+}
+
+func TestContextSkipUntil(t *testing.T) {
+	order := []string{}
+	var skipErr error
+
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			anyAction(func(ctx *Context) error {
+				if err := ctx.SkipUntil("missing"); !errors.Is(err, ErrLabelNotFound) {
+					skipErr = err
+				}
+				return ctx.SkipUntil("publish")
+			}),
+			anyAction(func(_ *Context) error { order = append(order, "skipped"); return nil }),
+			Label("publish", anyAction(func(_ *Context) error { order = append(order, "publish"); return nil })),
+		},
+		Name:   "TestQueue",
+		Logger: &testLogger{},
+	})
+
+	result := queue.Run(map[string]any{})
+
+	if skipErr != nil || result.Err != nil {
+		t.Fatalf("unexpected errors: %v, %v", skipErr, result.Err)
+	}
+	if len(order) != 1 || order[0] != "publish" {
+		t.Fatalf("unexpected order: %v", order)
+	}
+}
+
+func TestContextRestartStopsAtJumpLimit(t *testing.T) {
+	runs := 0
+
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			anyAction(func(ctx *Context) error {
+				runs++
+				return ctx.Restart()
+			}),
+		},
+		Name:     "TestQueue",
+		Logger:   &testLogger{},
+		MaxJumps: 3,
+	})
+
+	result := queue.Run(map[string]any{})
+
+	if !errors.Is(result.Err, ErrJumpLimit) {
+		t.Fatalf("expected ErrJumpLimit, got %v", result.Err)
+	}
+	if runs != 4 {
+		t.Fatalf("expected 4 runs, got %d", runs)
+	}
+}
@@ -0,0 +1,294 @@
+package queuerunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrInvalidTTL = errors.New("lease TTL must be positive")
+
+var ErrLeaseExpired = errors.New("lock lease expired")
+
+var ErrStaleFencingToken = errors.New("fencing token is stale")
+
+var ErrLeaseReentered = errors.New("lease requested on a scope its owner already holds")
+
+type LeaseExpiredError struct {
+	Scope string
+	TTL   time.Duration
+	Token uint64
+}
+
+func (err *LeaseExpiredError) Error() string {
+	return fmt.Sprintf("%v: scope %q, token %d, after %v", ErrLeaseExpired, err.Scope, err.Token, err.TTL)
+}
+
+func (err *LeaseExpiredError) Unwrap() error {
+	return ErrLeaseExpired
+}
+
+// LeaseLockingContext is implemented by locking contexts whose exclusive
+// holds can expire. WithLease falls back to a plain exclusive hold, without
+// expiry or fencing tokens, when the queue's locking context does not
+// implement it.
+type LeaseLockingContext interface {
+	LockingContext
+	RunWithLease(ctx context.Context, scope string, ttl time.Duration, fn func(lease *Lease) error) error
+}
+
+// Lease is an exclusive hold of a scope that is released by the lock
+// manager unless it is renewed within its TTL. When that happens the
+// lease's context is cancelled. Token grows with every lease granted on the
+// scope, so downstream code can reject writes carrying an older token, or
+// check it with CheckFencingToken.
+type Lease struct {
+	Scope string
+	Token uint64
+
+	manager    *LockManager
+	hold       *lockHold
+	ttl        time.Duration
+	ctx        context.Context
+	cancel     context.CancelFunc
+	timer      Timer
+	generation int
+	expires    time.Time
+	expired    bool
+	ended      bool
+}
+
+// AcquireLease takes scope exclusively, waiting until it is free or ctx is
+// done, and holds it for ttl. The lease's context is derived from ctx. With
+// reentrancy, an owner that already holds scope cannot lease it, since the
+// lease could not take the scope away from its outer hold; that fails with
+// ErrLeaseReentered.
+func (manager *LockManager) AcquireLease(ctx context.Context, scope string, ttl time.Duration) (*Lease, error) {
+	if err := ValidateScope(scope); err != nil {
+		return nil, err
+	}
+	if ttl <= 0 {
+		return nil, ErrInvalidTTL
+	}
+
+	holds, err := manager.acquire(ctx, []string{scope}, exclusiveLock, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if hold := holds[0]; hold.count > 1 {
+		manager.drop(hold)
+		return nil, fmt.Errorf("%w: %q", ErrLeaseReentered, scope)
+	}
+
+	manager.fences[scope]++
+	lease := &Lease{Scope: scope, Token: manager.fences[scope], manager: manager, hold: holds[0], ttl: ttl}
+	lease.ctx, lease.cancel = context.WithCancel(ctx)
+	lease.hold.lease = lease
+	manager.leases[scope] = lease
+	lease.arm()
+	return lease, nil
+}
+
+// RunWithLease runs fn under a lease of scope and releases it afterwards.
+// If the lease expired in the meantime, it fails with a *LeaseExpiredError.
+func (manager *LockManager) RunWithLease(ctx context.Context, scope string, ttl time.Duration, fn func(lease *Lease) error) error {
+	lease, err := manager.AcquireLease(ctx, scope, ttl)
+	if err != nil {
+		return err
+	}
+	defer lease.Release()
+
+	err = fn(lease)
+	if lease.Expired() {
+		return lease.expiredError()
+	}
+	return err
+}
+
+// CheckFencingToken reports whether token belongs to the lease currently
+// holding scope. It fails with ErrStaleFencingToken once that lease expired
+// or was released.
+func (manager *LockManager) CheckFencingToken(scope string, token uint64) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if lease, ok := manager.leases[scope]; !ok || lease.Token != token {
+		return fmt.Errorf("%w: scope %q, token %d", ErrStaleFencingToken, scope, token)
+	}
+	return nil
+}
+
+// Context is cancelled when the lease expires or is released.
+func (lease *Lease) Context() context.Context {
+	return lease.ctx
+}
+
+func (lease *Lease) Expires() time.Time {
+	lease.manager.mu.Lock()
+	defer lease.manager.mu.Unlock()
+	return lease.expires
+}
+
+func (lease *Lease) Expired() bool {
+	lease.manager.mu.Lock()
+	defer lease.manager.mu.Unlock()
+	return lease.expired
+}
+
+// Renew extends the lease by its TTL from now. An expired lease cannot be
+// renewed; the scope may already belong to someone else.
+func (lease *Lease) Renew() error {
+	manager := lease.manager
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if lease.expired {
+		return lease.expiredError()
+	}
+	if lease.ended {
+		return fmt.Errorf("%w: %q", ErrLockNotHeld, lease.Scope)
+	}
+	lease.timer.Stop()
+	lease.arm()
+	return nil
+}
+
+func (lease *Lease) Release() {
+	manager := lease.manager
+	manager.mu.Lock()
+	if lease.ended {
+		manager.mu.Unlock()
+		return
+	}
+	lease.ended = true
+	lease.timer.Stop()
+	manager.forget(lease)
+	manager.drop(lease.hold)
+	manager.mu.Unlock()
+
+	lease.cancel()
+}
+
+// arm starts the expiry timer. Every renewal starts a new generation, so an
+// expiry that fired while the lease was being renewed is ignored.
+func (lease *Lease) arm() {
+	clock := lease.manager.clock
+	lease.generation++
+	generation := lease.generation
+	lease.expires = clock.Now().Add(lease.ttl)
+	lease.timer = clock.AfterFunc(lease.ttl, func() { lease.manager.expire(lease, generation) })
+}
+
+func (lease *Lease) expiredError() error {
+	return &LeaseExpiredError{Scope: lease.Scope, TTL: lease.ttl, Token: lease.Token}
+}
+
+// expire takes the scope away from a lease that was not renewed in time and
+// cancels its context. Holds its owner took on the scope after the lease
+// are released with it; releasing them later does nothing.
+func (manager *LockManager) expire(lease *Lease, generation int) {
+	manager.mu.Lock()
+	if lease.ended || lease.generation != generation {
+		manager.mu.Unlock()
+		return
+	}
+	lease.ended = true
+	lease.expired = true
+	manager.forget(lease)
+	lease.hold.count = 1
+	manager.drop(lease.hold)
+	owner := lease.hold.owner
+	manager.mu.Unlock()
+
+	lease.cancel()
+	manager.logger.Info(fmt.Sprintf("LockManager: lease on scope %q held by %s expired after %v", lease.Scope, displayName(ownerName(owner)), lease.ttl))
+}
+
+func (manager *LockManager) forget(lease *Lease) {
+	if manager.leases[lease.Scope] == lease {
+		delete(manager.leases, lease.Scope)
+	}
+}
+
+// Context returns a context that is cancelled when a lease taken with
+// WithLease around the running action expires. Long-running actions should
+// pass it on to the work they start.
+func (ctx *Context) Context() context.Context {
+	if ctx == nil || ctx.current == nil {
+		return context.Background()
+	}
+	return ctx.current
+}
+
+// RenewLock extends the lease that WithLease holds on scope around the
+// running action. It fails with a *LeaseExpiredError once the lease has
+// expired and with ErrLockNotHeld when there is no such lease.
+func (ctx *Context) RenewLock(scope string) error {
+	lease, ok := ctx.lease(scope)
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrLockNotHeld, scope)
+	}
+	if lease == nil {
+		return nil
+	}
+	return lease.Renew()
+}
+
+// FencingToken returns the token of the lease that WithLease holds on
+// scope around the running action. Locking contexts without leases hand
+// out no tokens.
+func (ctx *Context) FencingToken(scope string) (uint64, bool) {
+	lease, ok := ctx.lease(scope)
+	if !ok || lease == nil {
+		return 0, false
+	}
+	return lease.Token, true
+}
+
+func (ctx *Context) lease(scope string) (*Lease, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	lease, ok := ctx.leases[scope]
+	return lease, ok
+}
+
+// enterLease makes lease the running action's lease of scope until the
+// returned function restores the previous state. A nil lease stands for a
+// hold taken by a locking context without leases.
+func (ctx *Context) enterLease(scope string, lease *Lease) func() {
+	previous, held := ctx.leases[scope]
+	current := ctx.current
+	if ctx.leases == nil {
+		ctx.leases = map[string]*Lease{}
+	}
+	ctx.leases[scope] = lease
+	if lease != nil {
+		ctx.current = lease.Context()
+	}
+
+	return func() {
+		ctx.current = current
+		if held {
+			ctx.leases[scope] = previous
+		} else {
+			delete(ctx.leases, scope)
+		}
+	}
+}
+
+type queueContextKey struct{}
+
+func contextWithQueueContext(parent context.Context, ctx *Context) context.Context {
+	return context.WithValue(parent, queueContextKey{}, ctx)
+}
+
+func queueContextOf(ctx context.Context) *Context {
+	queueCtx, _ := ctx.Value(queueContextKey{}).(*Context)
+	return queueCtx
+}
@@ -0,0 +1,179 @@
+package queuerunner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLeaseExpiresUnlessRenewed(t *testing.T) {
+	clock := newTestClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	manager := NewLockManagerWithOpts(LockManagerOpts{Clock: clock, Logger: &testLogger{}})
+
+	lease, err := manager.AcquireLease(context.Background(), "db", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(40 * time.Second)
+	if err := lease.Renew(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(40 * time.Second)
+	if lease.Expired() || !manager.IsLocked("db") {
+		t.Fatal("expected the renewed lease to be held")
+	}
+	if err := manager.CheckFencingToken("db", lease.Token); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Minute)
+	if !lease.Expired() || manager.IsLocked("db") {
+		t.Fatal("expected the lease to expire and release the scope")
+	}
+	select {
+	case <-lease.Context().Done():
+	default:
+		t.Fatal("expected the lease context to be cancelled")
+	}
+	if err := lease.Renew(); !errors.Is(err, ErrLeaseExpired) {
+		t.Fatalf("expected ErrLeaseExpired, got %v", err)
+	}
+	if err := manager.CheckFencingToken("db", lease.Token); !errors.Is(err, ErrStaleFencingToken) {
+		t.Fatalf("expected ErrStaleFencingToken, got %v", err)
+	}
+
+	next, err := manager.AcquireLease(context.Background(), "db", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Token <= lease.Token {
+		t.Fatalf("expected a larger token than %d, got %d", lease.Token, next.Token)
+	}
+	next.Release()
+	lease.Release()
+	if manager.IsLocked("db") {
+		t.Fatal("expected the scope to be free")
+	}
+	if err := manager.CheckFencingToken("db", next.Token); !errors.Is(err, ErrStaleFencingToken) {
+		t.Fatalf("expected a released lease's token to be stale, got %v", err)
+	}
+}
+
+func TestWithLeaseCancelsExpiredHolder(t *testing.T) {
+	clock := newTestClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	locking := NewLockManagerWithOpts(LockManagerOpts{Clock: clock, Logger: &testLogger{}})
+	started := make(chan uint64, 1)
+	var renewErr error
+	hang := func(ctx *Context) error {
+		token, _ := ctx.FencingToken("db")
+		started <- token
+		<-ctx.Context().Done()
+		renewErr = ctx.RenewLock("db")
+		return ctx.Context().Err()
+	}
+
+	queue := NewQueue(QueueOpts{
+		Actions:        []Action{WithLease("db", time.Minute, hang)},
+		Logger:         &testLogger{},
+		LockingContext: locking,
+	})
+	subscription := queue.Subscribe(64)
+	results := make(chan RunResult, 1)
+	go func() { results <- queue.Run(map[string]any{}) }()
+
+	token := <-started
+	if token == 0 {
+		t.Fatal("expected a fencing token")
+	}
+	clock.Advance(time.Minute)
+	if err := locking.CheckFencingToken("db", token); !errors.Is(err, ErrStaleFencingToken) {
+		t.Fatalf("expected the token to be stale, got %v", err)
+	}
+
+	result := <-results
+	var expired *LeaseExpiredError
+	if !errors.As(result.Err, &expired) || expired.Scope != "db" || expired.Token != token {
+		t.Fatalf("expected a lease expiry, got %v", result.Err)
+	}
+	if !errors.Is(renewErr, ErrLeaseExpired) {
+		t.Fatalf("expected renewing to fail, got %v", renewErr)
+	}
+
+	found := false
+	for len(subscription.Events) > 0 {
+		if event, ok := (<-subscription.Events).(LockExpired); ok && event.Scope == "db" && event.Token == token {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected a LockExpired event")
+	}
+}
+
+func TestWithLeaseFallsBackToPlainLock(t *testing.T) {
+	manager := NewLockManager()
+	var renewErr error
+	var hasToken bool
+	action := func(ctx *Context) error {
+		renewErr = ctx.RenewLock("db")
+		_, hasToken = ctx.FencingToken("db")
+		return nil
+	}
+
+	queue := NewQueue(QueueOpts{
+		Actions:        []Action{WithLease("db", time.Minute, action)},
+		Logger:         &testLogger{},
+		LockingContext: exclusiveOnly{manager},
+	})
+	if result := queue.Run(map[string]any{}); result.Err != nil {
+		t.Fatal(result.Err)
+	}
+
+	if renewErr != nil || hasToken {
+		t.Fatalf("expected a lease without expiry or token, got %v, %v", renewErr, hasToken)
+	}
+	if err := (&Context{}).RenewLock("db"); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatalf("expected ErrLockNotHeld, got %v", err)
+	}
+}
+
+func TestLeaseOnReenteredScope(t *testing.T) {
+	clock := newTestClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	manager := NewLockManagerWithOpts(LockManagerOpts{Clock: clock, Reentrant: true, Logger: &testLogger{}})
+	owner := ContextWithLockOwner(context.Background(), NewLockOwner("import"))
+
+	if err := manager.LockContext(owner, "db"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.AcquireLease(owner, "db", time.Minute); !errors.Is(err, ErrLeaseReentered) {
+		t.Fatalf("expected ErrLeaseReentered, got %v", err)
+	}
+	manager.Unlock("db")
+	if manager.IsLocked("db") {
+		t.Fatal("expected the rejected lease to leave no hold behind")
+	}
+
+	lease, err := manager.AcquireLease(owner, "db", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.LockContext(owner, "db"); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	if !lease.Expired() || manager.IsLocked("db") {
+		t.Fatal("expected the expired lease to release the re-entered hold")
+	}
+
+	manager.Unlock("db")
+	other := ContextWithLockOwner(context.Background(), NewLockOwner("report"))
+	next, err := manager.AcquireLease(other, "db", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Release()
+	if manager.IsLocked("db") {
+		t.Fatal("expected the scope to be free")
+	}
+}
@@ -0,0 +1,114 @@
+package queuerunner
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const historySize = 10
+
+const (
+	LimitMaxSteps       = "MaxSteps"
+	LimitMaxQueueLength = "MaxQueueLength"
+	LimitMaxPushDepth   = "MaxPushDepth"
+	LimitMaxRunTime     = "MaxRunTime"
+)
+
+var ErrLimitExceeded = errors.New("queue limit exceeded")
+
+type Limits struct {
+	MaxSteps       int
+	MaxQueueLength int
+	MaxPushDepth   int
+	// MaxRunTime is checked before every step. Once it elapses, the
+	// queue's Context().Done() is closed as well, so actions that wait on it
+	// and lock requests give up.
+	MaxRunTime time.Duration
+}
+
+type LimitError struct {
+	Limit   string
+	Max     any
+	History []string
+}
+
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("%v: %s %v, recent actions: %s", ErrLimitExceeded, err.Limit, err.Max, strings.Join(err.History, ", "))
+}
+
+func (err *LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+func (queue *Queue) checkLimits(started time.Time) error {
+	if queue.checkLength() != nil {
+		return queue.exceeded
+	}
+
+	limits := queue.limits
+	if limits.MaxRunTime > 0 && time.Since(started) > limits.MaxRunTime {
+		return queue.exceed(LimitMaxRunTime, limits.MaxRunTime)
+	}
+
+	queue.steps++
+	if limits.MaxSteps > 0 && queue.steps > limits.MaxSteps {
+		return queue.exceed(LimitMaxSteps, limits.MaxSteps)
+	}
+
+	return nil
+}
+
+func (queue *Queue) overran() bool {
+	max := queue.limits.MaxRunTime
+	return max > 0 && time.Since(queue.started) >= max
+}
+
+func (queue *Queue) checkLength() error {
+	max := queue.limits.MaxQueueLength
+	if max > 0 && queue.queue.Len() > max {
+		return queue.exceed(LimitMaxQueueLength, max)
+	}
+	return nil
+}
+
+// pushDepth returns the depth for actions added by the running action and
+// reports false when there is nothing to add or the push must be refused.
+func (queue *Queue) pushDepth(actions []Action) (int, bool) {
+	if len(actions) == 0 || queue.exceeded != nil {
+		return 0, false
+	}
+
+	depth := queue.depth + 1
+	max := queue.limits.MaxPushDepth
+	if max > 0 && depth > max {
+		queue.exceed(LimitMaxPushDepth, max)
+		return 0, false
+	}
+
+	return depth, true
+}
+
+func (queue *Queue) exceed(limit string, max any) error {
+	if queue.exceeded != nil {
+		return queue.exceeded
+	}
+
+	err := &LimitError{Limit: limit, Max: max, History: append([]string{}, queue.history...)}
+	queue.exceeded = err
+	queue.fail(err)
+
+	queue.logger.Info(fmt.Sprintf("Queue(%s): limit exceeded", queue.name))
+	queue.logger.Error(err)
+	queue.Abort()
+	return err
+}
+
+func (queue *Queue) remember(name string) {
+	if len(queue.history) == historySize {
+		copy(queue.history, queue.history[1:])
+		queue.history = queue.history[:historySize-1]
+	}
+	queue.history = append(queue.history, name)
+}
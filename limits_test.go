@@ -0,0 +1,97 @@
+package queuerunner
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func runawayQueue(limits Limits, action Action) RunResult {
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{action},
+		Name:    "TestQueue",
+		Logger:  &testLogger{},
+		Limits:  limits,
+	})
+	return queue.Run(map[string]any{})
+}
+
+func TestLimitMaxSteps(t *testing.T) {
+	var loop Action
+	loop = anyAction(func(ctx *Context) error {
+		ctx.Append([]Action{loop})
+		return nil
+	})
+
+	result := runawayQueue(Limits{MaxSteps: 5}, loop)
+
+	var limitErr *LimitError
+	if !errors.As(result.Err, &limitErr) || limitErr.Limit != LimitMaxSteps {
+		t.Fatalf("expected MaxSteps error, got %v", result.Err)
+	}
+	if len(limitErr.History) != 5 || !result.Aborted {
+		t.Fatalf("unexpected history or result: %+v", result)
+	}
+}
+
+func TestLimitMaxQueueLength(t *testing.T) {
+	result := runawayQueue(Limits{MaxQueueLength: 3}, anyAction(func(ctx *Context) error {
+		ctx.Push([]Action{Util.Abort, Util.Abort, Util.Abort, Util.Abort})
+		return nil
+	}))
+
+	var limitErr *LimitError
+	if !errors.As(result.Err, &limitErr) || limitErr.Limit != LimitMaxQueueLength {
+		t.Fatalf("expected MaxQueueLength error, got %v", result.Err)
+	}
+}
+
+func TestLimitMaxPushDepth(t *testing.T) {
+	var nested Action
+	nested = Util.If(func(_ *Context) (bool, error) { return true, nil }, Branches{
+		Then: []Action{anyAction(func(ctx *Context) error {
+			ctx.Push([]Action{nested})
+			return nil
+		})},
+	})
+
+	result := runawayQueue(Limits{MaxPushDepth: 4}, nested)
+
+	var limitErr *LimitError
+	if !errors.As(result.Err, &limitErr) || limitErr.Limit != LimitMaxPushDepth {
+		t.Fatalf("expected MaxPushDepth error, got %v", result.Err)
+	}
+}
+
+func TestLimitMaxRunTime(t *testing.T) {
+	var loop Action
+	loop = anyAction(func(ctx *Context) error {
+		time.Sleep(time.Millisecond)
+		ctx.Push([]Action{loop})
+		return nil
+	})
+
+	result := runawayQueue(Limits{MaxRunTime: 10 * time.Millisecond}, loop)
+
+	if !errors.Is(result.Err, ErrLimitExceeded) {
+		t.Fatalf("expected limit error, got %v", result.Err)
+	}
+}
+
+func TestLimitMaxRunTimeCancelsContext(t *testing.T) {
+	hang := anyAction(func(ctx *Context) error {
+		select {
+		case <-ctx.Context().Done():
+			return ctx.Context().Err()
+		case <-time.After(time.Second):
+			return errors.New("context was not cancelled")
+		}
+	})
+
+	result := runawayQueue(Limits{MaxRunTime: 10 * time.Millisecond}, hang)
+
+	var limitErr *LimitError
+	if !errors.As(result.Err, &limitErr) || limitErr.Limit != LimitMaxRunTime || !result.Aborted {
+		t.Fatalf("expected an aborting MaxRunTime error, got %+v", result)
+	}
+}
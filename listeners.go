@@ -0,0 +1,122 @@
+package queuerunner
+
+import (
+	"fmt"
+	"sync"
+)
+
+type endListenerEntry struct {
+	id       uint64
+	listener EndListener
+}
+
+// AddEndListener registers listener and returns a function that removes it.
+// Listeners may be added and removed while queues are running.
+func (runner *QueueRunner) AddEndListener(listener EndListener) func() {
+	if listener == nil {
+		return func() {}
+	}
+
+	runner.mu.Lock()
+	runner.listenerID++
+	id := runner.listenerID
+	listeners := make([]endListenerEntry, 0, len(runner.listeners)+1)
+	listeners = append(listeners, runner.listeners...)
+	runner.listeners = append(listeners, endListenerEntry{id: id, listener: listener})
+	runner.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			runner.removeEndListener(id)
+		})
+	}
+}
+
+// removeEndListener replaces the listener slice instead of editing it in
+// place, so a snapshot taken by onQueueEnd is never modified underneath it.
+func (runner *QueueRunner) removeEndListener(id uint64) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+
+	listeners := make([]endListenerEntry, 0, len(runner.listeners))
+	for _, entry := range runner.listeners {
+		if entry.id != id {
+			listeners = append(listeners, entry)
+		}
+	}
+	runner.listeners = listeners
+}
+
+func (runner *QueueRunner) notifyEnd(listeners []endListenerEntry, name string, size int) {
+	if len(listeners) == 0 {
+		return
+	}
+
+	notify := func() {
+		for _, entry := range listeners {
+			runner.callEndListener(entry.listener, name, size)
+		}
+	}
+
+	if runner.dispatcher != nil {
+		runner.dispatcher.dispatch(notify)
+		return
+	}
+	notify()
+}
+
+func (runner *QueueRunner) callEndListener(listener EndListener, name string, size int) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logger := runner.log()
+			logger.Info(fmt.Sprintf("QueueRunner: end listener for Queue(%s) failed", name))
+			if err, ok := recovered.(error); ok {
+				logger.Error(err)
+			} else {
+				logger.Error(fmt.Errorf("%v", recovered))
+			}
+		}
+	}()
+
+	listener(name, size)
+}
+
+// listenerDispatcher runs notifications one after another on a background
+// goroutine that only lives while there is something to deliver.
+type listenerDispatcher struct {
+	mu      sync.Mutex
+	pending []func()
+	running bool
+}
+
+func (dispatcher *listenerDispatcher) dispatch(notify func()) {
+	dispatcher.mu.Lock()
+	dispatcher.pending = append(dispatcher.pending, notify)
+	if dispatcher.running {
+		dispatcher.mu.Unlock()
+		return
+	}
+	dispatcher.running = true
+	dispatcher.mu.Unlock()
+
+	go dispatcher.drain()
+}
+
+func (dispatcher *listenerDispatcher) drain() {
+	for {
+		dispatcher.mu.Lock()
+		if len(dispatcher.pending) == 0 {
+			dispatcher.running = false
+			dispatcher.mu.Unlock()
+			return
+		}
+		pending := dispatcher.pending
+		dispatcher.pending = nil
+		dispatcher.mu.Unlock()
+
+		for _, notify := range pending {
+			notify()
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package queuerunner
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEndListenersConcurrentRegistration(t *testing.T) {
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}})
+	var calls int32
+
+	var wg sync.WaitGroup
+	for index := 0; index < 20; index++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			runner.Add([]Action{Util.Delay(time.Millisecond)}, map[string]any{}, "")
+		}()
+		go func() {
+			defer wg.Done()
+			remove := runner.AddEndListener(func(_ string, _ int) {
+				atomic.AddInt32(&calls, 1)
+			})
+			time.Sleep(time.Millisecond)
+			remove()
+			remove()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEndListenerPanicIsIsolated(t *testing.T) {
+	logger := &testLogger{}
+	done := make(chan struct{})
+
+	runner := NewQueueRunner(RunnerOpts{Logger: logger})
+	runner.AddEndListener(func(_ string, _ int) {
+		panic("listener failed")
+	})
+	remove := runner.AddEndListener(func(_ string, _ int) {
+		t.Error("removed listener was called")
+	})
+	remove()
+	runner.AddEndListener(func(_ string, _ int) {
+		close(done)
+	})
+
+	runner.Add([]Action{Util.Delay(0)}, map[string]any{}, "")
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("listener after a panicking one was not called")
+	}
+	if logger.ErrorCount() != 1 {
+		t.Fatalf("expected listener panic to be logged, got %d errors", logger.ErrorCount())
+	}
+}
+
+func TestAsyncEndListenersKeepOrder(t *testing.T) {
+	var mu sync.Mutex
+	names := []string{}
+	done := make(chan struct{})
+	release := make(chan struct{})
+
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}, AsyncListeners: true})
+	runner.AddEndListener(func(name string, _ int) {
+		<-release
+		mu.Lock()
+		names = append(names, name)
+		if len(names) == 2 {
+			close(done)
+		}
+		mu.Unlock()
+	})
+
+	runner.Add([]Action{Util.Delay(0)}, map[string]any{}, "first")
+	time.Sleep(10 * time.Millisecond)
+	runner.Add([]Action{Util.Delay(0)}, map[string]any{}, "second")
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for async listeners")
+	}
+	if names[0] != "first" || names[1] != "second" {
+		t.Fatalf("unexpected order: %v", names)
+	}
+}
@@ -1,9 +1,12 @@
 package queuerunner
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"strings"
 	"sync"
+	"time"
 )
 
 var ErrInvalidScope = errors.New("lock scope must be a non-empty string")
@@ -23,94 +26,611 @@ type LockingContext interface {
 	RunWithLock(scope string, fn func() error) error
 }
 
+// SharedLockingContext is implemented by locking contexts that also hand out
+// shared (read) holds. WithRLock falls back to an exclusive hold when the
+// queue's locking context does not implement it.
+type SharedLockingContext interface {
+	LockingContext
+	RLockBlocked(scope string) bool
+	RLock(scope string) error
+	RUnlock(scope string)
+	RunWithRLock(scope string, fn func() error) error
+}
+
+// SemaphoreLockingContext is implemented by locking contexts that let up to
+// capacity holders share a scope. WithSemaphore falls back to an exclusive
+// hold when the queue's locking context does not implement it.
+type SemaphoreLockingContext interface {
+	LockingContext
+	SemaphoreBlocked(scope string, capacity int) bool
+	RunWithSemaphore(ctx context.Context, scope string, capacity int, fn func() error) error
+}
+
+// ContextLockingContext is implemented by locking contexts whose waits can
+// be cancelled. WithLockTimeout polls Lock on contexts that do not implement
+// it.
+type ContextLockingContext interface {
+	LockingContext
+	WaitContext(ctx context.Context, scope string) error
+	RunWithLockContext(ctx context.Context, scope string, fn func() error) error
+}
+
+var ErrInvalidCapacity = errors.New("semaphore capacity must be positive")
+
+var ErrLockTimeout = errors.New("timed out waiting for lock")
+
+type LockTimeoutError struct {
+	Scope   string
+	Timeout time.Duration
+}
+
+func (err *LockTimeoutError) Error() string {
+	return fmt.Sprintf("%v: scope %q after %v", ErrLockTimeout, err.Scope, err.Timeout)
+}
+
+func (err *LockTimeoutError) Unwrap() error {
+	return ErrLockTimeout
+}
+
+type SemaphoreStats struct {
+	Capacity int
+	Holders  int
+	Waiting  int
+}
+
+type lockMode int
+
+const (
+	exclusiveLock lockMode = iota
+	sharedLock
+	semaphoreLock
+)
+
+// lockScope is the state of one scope. Every release closes changed and
+// replaces it, waking everyone waiting on the scope to re-check it.
+// Waiters are counted per mode, which keeps the scope around while they
+// wait and lets new readers and semaphore holders queue behind waiting
+// writers instead of starving them.
+type lockScope struct {
+	name     string
+	writer   bool
+	readers  int
+	permits  int
+	capacity int
+	holds    []*lockHold
+	waiting  [3]int
+	changed  chan struct{}
+	manager  *LockManager
+	queue    []*lockWaiter
+}
+
+// lockHold is one holder of a scope. Holds taken through the plain
+// LockingContext methods have no owner. The count drops to zero once the
+// hold is released.
+type lockHold struct {
+	scope  *lockScope
+	mode   lockMode
+	owner  *LockOwner
+	action string
+	count  int
+	since  time.Time
+	timer  Timer
+	lease  *Lease
+}
+
+func (state *lockScope) held() bool {
+	return state.writer || state.readers > 0 || state.permits > 0
+}
+
+func (state *lockScope) idle() bool {
+	return !state.held() && state.waiting == [3]int{}
+}
+
+// available reports whether a new request could take the scope right away.
+// With FIFO ordering that needs an empty wait queue; with racing ordering
+// only waiting writers hold others back.
+func (state *lockScope) available(mode lockMode, capacity int) bool {
+	if state.manager.fair {
+		return len(state.queue) == 0 && state.compatible(mode, capacity)
+	}
+	if mode != exclusiveLock && state.waiting[exclusiveLock] > 0 {
+		return false
+	}
+	return state.compatible(mode, capacity)
+}
+
+func (state *lockScope) compatible(mode lockMode, capacity int) bool {
+	switch mode {
+	case sharedLock:
+		return !state.writer
+	case semaphoreLock:
+		return !state.writer && state.permits < capacity
+	}
+	return !state.held()
+}
+
+type LockOrdering int
+
+const (
+	// LockFIFO hands a released scope to the longest waiting request, with
+	// higher priorities first.
+	LockFIFO LockOrdering = iota
+	// LockRacing wakes every waiter on release and lets them race for the
+	// scope, which is how LockManager used to behave.
+	LockRacing
+)
+
+type LockManagerOpts struct {
+	Ordering LockOrdering
+	// Reentrant lets an owner that holds a scope take it again without
+	// waiting, as when a locked action of a queue runs another action
+	// locking the same scope. Every acquisition needs its own release.
+	Reentrant bool
+	// LongHold, when positive, reports every hold that lasts longer than it,
+	// once per hold, to OnLongHold or, without one, to Logger.
+	LongHold   time.Duration
+	OnLongHold func(scope string, holder LockHolder)
+	Logger     Logger
+	Clock      Clock
+}
+
 type LockManager struct {
-	mu     sync.Mutex
-	scopes map[string]chan struct{}
+	mu         sync.Mutex
+	scopes     map[string]*lockScope
+	waiters    map[*lockWaiter]struct{}
+	fair       bool
+	reentrant  bool
+	clock      Clock
+	longHold   time.Duration
+	onLongHold func(scope string, holder LockHolder)
+	logger     Logger
+	fences     map[string]uint64
+	leases     map[string]*Lease
 }
 
 func NewLockManager() *LockManager {
-	return &LockManager{
-		scopes: map[string]chan struct{}{},
+	return NewLockManagerWithOpts(LockManagerOpts{})
+}
+
+func NewLockManagerWithOpts(opts LockManagerOpts) *LockManager {
+	manager := &LockManager{
+		scopes:     map[string]*lockScope{},
+		waiters:    map[*lockWaiter]struct{}{},
+		fair:       opts.Ordering == LockFIFO,
+		reentrant:  opts.Reentrant,
+		clock:      opts.Clock,
+		longHold:   opts.LongHold,
+		onLongHold: opts.OnLongHold,
+		logger:     opts.Logger,
+		fences:     map[string]uint64{},
+		leases:     map[string]*Lease{},
+	}
+
+	if manager.clock == nil {
+		manager.clock = realClock{}
 	}
+	if manager.logger == nil {
+		manager.logger = defaultLogger()
+	}
+
+	return manager
 }
 
 func (manager *LockManager) IsLocked(scope string) bool {
 	manager.mu.Lock()
 	defer manager.mu.Unlock()
-	_, ok := manager.scopes[scope]
-	return ok
+	state, ok := manager.scopes[scope]
+	return ok && state.held()
+}
+
+// RLockBlocked reports whether a reader asking for the scope now would have
+// to wait, because a writer holds it or is waiting for it.
+func (manager *LockManager) RLockBlocked(scope string) bool {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	state, ok := manager.scopes[scope]
+	return ok && !state.available(sharedLock, 0)
 }
 
 func (manager *LockManager) Lock(scope string) error {
+	return manager.tryAcquire(scope, exclusiveLock)
+}
+
+func (manager *LockManager) RLock(scope string) error {
+	return manager.tryAcquire(scope, sharedLock)
+}
+
+func (manager *LockManager) Unlock(scope string) {
+	manager.releaseScope(scope, exclusiveLock)
+}
+
+func (manager *LockManager) RUnlock(scope string) {
+	manager.releaseScope(scope, sharedLock)
+}
+
+func (manager *LockManager) Wait(scope string) error {
+	return manager.WaitContext(context.Background(), scope)
+}
+
+// WaitContext waits until nobody holds scope or ctx is done. A release
+// that leaves other holders, such as one of several readers, does not end
+// the wait.
+func (manager *LockManager) WaitContext(ctx context.Context, scope string) error {
+	if err := ValidateScope(scope); err != nil {
+		return err
+	}
+
+	for {
+		manager.mu.Lock()
+		state, ok := manager.scopes[scope]
+		if !ok || !state.held() {
+			manager.mu.Unlock()
+			return nil
+		}
+		changed := state.changed
+		manager.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// LockContext takes scope exclusively, waiting until it is free or ctx is
+// done. Unlike Lock it does not fail when the scope is held.
+func (manager *LockManager) LockContext(ctx context.Context, scope string) error {
 	if err := ValidateScope(scope); err != nil {
 		return err
 	}
+	_, err := manager.acquire(ctx, []string{scope}, exclusiveLock, 0)
+	return err
+}
 
+func (manager *LockManager) RLockContext(ctx context.Context, scope string) error {
+	if err := ValidateScope(scope); err != nil {
+		return err
+	}
+	_, err := manager.acquire(ctx, []string{scope}, sharedLock, 0)
+	return err
+}
+
+func (manager *LockManager) RunWithLock(scope string, fn func() error) error {
+	return manager.RunWithLockContext(context.Background(), scope, fn)
+}
+
+func (manager *LockManager) RunWithLockContext(ctx context.Context, scope string, fn func() error) error {
+	if err := ValidateScope(scope); err != nil {
+		return err
+	}
+	return manager.runWith(ctx, []string{scope}, exclusiveLock, 0, fn)
+}
+
+func (manager *LockManager) RunWithRLock(scope string, fn func() error) error {
+	return manager.RunWithRLockContext(context.Background(), scope, fn)
+}
+
+func (manager *LockManager) RunWithRLockContext(ctx context.Context, scope string, fn func() error) error {
+	if err := ValidateScope(scope); err != nil {
+		return err
+	}
+	return manager.runWith(ctx, []string{scope}, sharedLock, 0, fn)
+}
+
+// SemaphoreBlocked reports whether a semaphore holder asking for the scope
+// now would have to wait.
+func (manager *LockManager) SemaphoreBlocked(scope string, capacity int) bool {
 	manager.mu.Lock()
 	defer manager.mu.Unlock()
+	state, ok := manager.scopes[scope]
+	return ok && !state.available(semaphoreLock, capacity)
+}
 
-	if _, ok := manager.scopes[scope]; ok {
-		return errors.New("scope is already locked")
+// AcquireSemaphore takes one of capacity slots of scope, waiting until a
+// slot is free or ctx is done. Every acquirer passes the capacity, so all
+// users of a scope are expected to agree on it.
+func (manager *LockManager) AcquireSemaphore(ctx context.Context, scope string, capacity int) error {
+	if err := ValidateScope(scope); err != nil {
+		return err
 	}
+	if capacity <= 0 {
+		return ErrInvalidCapacity
+	}
+	_, err := manager.acquire(ctx, []string{scope}, semaphoreLock, capacity)
+	return err
+}
 
-	manager.scopes[scope] = make(chan struct{})
-	return nil
+func (manager *LockManager) ReleaseSemaphore(scope string) {
+	manager.releaseScope(scope, semaphoreLock)
 }
 
-func (manager *LockManager) Unlock(scope string) {
+func (manager *LockManager) RunWithSemaphore(ctx context.Context, scope string, capacity int, fn func() error) error {
+	if err := ValidateScope(scope); err != nil {
+		return err
+	}
+	if capacity <= 0 {
+		return ErrInvalidCapacity
+	}
+	return manager.runWith(ctx, []string{scope}, semaphoreLock, capacity, fn)
+}
+
+func (manager *LockManager) Semaphore(scope string) SemaphoreStats {
 	manager.mu.Lock()
-	ch, ok := manager.scopes[scope]
-	if ok {
-		delete(manager.scopes, scope)
+	defer manager.mu.Unlock()
+
+	state, ok := manager.scopes[scope]
+	if !ok {
+		return SemaphoreStats{}
 	}
-	manager.mu.Unlock()
+	return SemaphoreStats{Capacity: state.capacity, Holders: state.permits, Waiting: state.waiting[semaphoreLock]}
+}
 
-	if ok {
-		close(ch)
+// runWith holds the scopes around fn and releases exactly the holds it
+// took, even when fn panics.
+func (manager *LockManager) runWith(ctx context.Context, scopes []string, mode lockMode, capacity int, fn func() error) error {
+	holds, err := manager.acquire(ctx, scopes, mode, capacity)
+	if err != nil {
+		return err
 	}
+	defer manager.release(holds)
+
+	return fn()
 }
 
-func (manager *LockManager) Wait(scope string) error {
+func (manager *LockManager) tryAcquire(scope string, mode lockMode) error {
 	if err := ValidateScope(scope); err != nil {
 		return err
 	}
 
 	manager.mu.Lock()
-	ch, ok := manager.scopes[scope]
-	manager.mu.Unlock()
+	defer manager.mu.Unlock()
 
-	if !ok {
+	state := manager.state(scope)
+	if !state.available(mode, 0) {
+		return errors.New("scope is already locked")
+	}
+	state.take(mode, 0, nil, "")
+	return nil
+}
+
+type lockWaitKey struct{}
+
+// contextWithLockWait returns a context whose lock requests call wait
+// before they block, which may happen more than once per request. Requests
+// that are granted right away never call it.
+func contextWithLockWait(ctx context.Context, wait func()) context.Context {
+	return context.WithValue(ctx, lockWaitKey{}, wait)
+}
+
+func beforeLockWait(ctx context.Context) {
+	if wait, ok := ctx.Value(lockWaitKey{}).(func()); ok {
+		wait()
+	}
+}
+
+// acquire blocks until all scopes can be taken in the given mode or ctx is
+// done, holding none of them in the meantime. With reentrancy, scopes the
+// requesting owner already holds are not waited for; their holds are
+// counted once more when the rest has been taken.
+func (manager *LockManager) acquire(ctx context.Context, scopes []string, mode lockMode, capacity int) ([]*lockHold, error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	owner := lockOwnerOf(ctx)
+	var reentered []*lockHold
+	states := make([]*lockScope, 0, len(scopes))
+	for _, scope := range scopes {
+		state := manager.state(scope)
+		if hold := manager.reentry(state, owner, mode); hold != nil {
+			reentered = append(reentered, hold)
+			continue
+		}
+		states = append(states, state)
+	}
+
+	var holds []*lockHold
+	if len(states) > 0 {
+		waiter := &lockWaiter{mode: mode, capacity: capacity, owner: owner, action: lockActionOf(ctx), since: manager.clock.Now(), scopes: states}
+		var err error
+		if manager.fair {
+			holds, err = manager.acquireFair(ctx, waiter)
+		} else {
+			holds, err = manager.acquireRacing(ctx, waiter)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, hold := range reentered {
+		hold.count++
+	}
+	return append(holds, reentered...), nil
+}
+
+// acquireRacing waits for every release of a scope that keeps the waiter
+// out and retries. A waiter that gives up withdraws its waiting counts and
+// wakes the others, since a departing writer may have been the only thing
+// holding readers back.
+func (manager *LockManager) acquireRacing(ctx context.Context, waiter *lockWaiter) ([]*lockHold, error) {
+	states, mode, capacity := waiter.scopes, waiter.mode, waiter.capacity
+	for _, state := range states {
+		state.wait(mode, 1)
+	}
+	defer delete(manager.waiters, waiter)
+	for blocked := firstBlocked(states, mode, capacity); blocked != nil; blocked = firstBlocked(states, mode, capacity) {
+		if _, waiting := manager.waiters[waiter]; !waiting {
+			manager.waiters[waiter] = struct{}{}
+			if err := manager.detectDeadlock(waiter); err != nil {
+				manager.withdraw(waiter)
+				return nil, err
+			}
+		}
+
+		changed := blocked.changed
+		manager.mu.Unlock()
+		beforeLockWait(ctx)
+		select {
+		case <-changed:
+			manager.mu.Lock()
+		case <-ctx.Done():
+			manager.mu.Lock()
+			manager.withdraw(waiter)
+			return nil, ctx.Err()
+		}
+	}
+	for _, state := range states {
+		state.wait(mode, -1)
+		waiter.holds = append(waiter.holds, state.take(mode, capacity, waiter.owner, waiter.action))
+	}
+	return waiter.holds, nil
+}
+
+// reentry returns the owner's hold on the scope that already covers a
+// request in the given mode: an exclusive hold covers everything, other
+// holds cover requests of their own mode. Upgrading a shared hold is not
+// reentrant and is reported as a deadlock instead.
+func (manager *LockManager) reentry(state *lockScope, owner *LockOwner, mode lockMode) *lockHold {
+	if !manager.reentrant || owner == nil {
 		return nil
 	}
+	for _, hold := range state.holds {
+		if hold.owner == owner && (hold.mode == exclusiveLock || hold.mode == mode) {
+			return hold
+		}
+	}
+	return nil
+}
+
+// withdraw takes back a racing waiter's waiting counts once it gives up.
+func (manager *LockManager) withdraw(waiter *lockWaiter) {
+	for _, state := range waiter.scopes {
+		state.wait(waiter.mode, -1)
+		manager.notify(state)
+	}
+}
 
-	<-ch
+func firstBlocked(states []*lockScope, mode lockMode, capacity int) *lockScope {
+	for _, state := range states {
+		if !state.available(mode, capacity) {
+			return state
+		}
+	}
 	return nil
 }
 
-func (manager *LockManager) RunWithLock(scope string, fn func() error) error {
-	if err := ValidateScope(scope); err != nil {
-		return err
+func (state *lockScope) wait(mode lockMode, delta int) {
+	state.waiting[mode] += delta
+}
+
+func (state *lockScope) take(mode lockMode, capacity int, owner *LockOwner, action string) *lockHold {
+	switch mode {
+	case sharedLock:
+		state.readers++
+	case semaphoreLock:
+		state.permits++
+		state.capacity = capacity
+	default:
+		state.writer = true
 	}
 
-	for {
-		manager.mu.Lock()
-		ch, ok := manager.scopes[scope]
-		if !ok {
-			ch = make(chan struct{})
-			manager.scopes[scope] = ch
-			manager.mu.Unlock()
+	manager := state.manager
+	hold := &lockHold{scope: state, mode: mode, owner: owner, action: action, count: 1, since: manager.clock.Now()}
+	state.holds = append(state.holds, hold)
+	if manager.longHold > 0 {
+		hold.timer = manager.clock.AfterFunc(manager.longHold, func() { manager.warn(hold) })
+	}
+	return hold
+}
 
-			err := fn()
+// releaseScope drops one hold of the given mode, preferring holds without an
+// owner, which are the ones the plain Lock and RLock methods take.
+func (manager *LockManager) releaseScope(scope string, mode lockMode) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
 
-			manager.mu.Lock()
-			delete(manager.scopes, scope)
-			manager.mu.Unlock()
+	state, ok := manager.scopes[scope]
+	if !ok {
+		return
+	}
 
-			close(ch)
-			return err
+	var found *lockHold
+	for _, hold := range state.holds {
+		if hold.mode != mode {
+			continue
 		}
-		manager.mu.Unlock()
+		if found == nil || hold.owner == nil {
+			found = hold
+		}
+		if hold.owner == nil {
+			break
+		}
+	}
+	if found != nil {
+		manager.drop(found)
+	}
+}
+
+func (manager *LockManager) release(holds []*lockHold) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	for _, hold := range holds {
+		manager.drop(hold)
+	}
+}
+
+// drop gives up one count of the hold and releases it with the last one.
+func (manager *LockManager) drop(hold *lockHold) {
+	if hold.count > 1 {
+		hold.count--
+		return
+	}
 
-		<-ch
+	state := hold.scope
+	for index, current := range state.holds {
+		if current != hold {
+			continue
+		}
+		state.holds = append(state.holds[:index], state.holds[index+1:]...)
+		hold.count = 0
+		if hold.timer != nil {
+			hold.timer.Stop()
+		}
+
+		switch hold.mode {
+		case sharedLock:
+			state.readers--
+			if state.readers > 0 {
+				return
+			}
+		case semaphoreLock:
+			state.permits--
+		default:
+			state.writer = false
+		}
+		manager.notify(state)
+		return
+	}
+}
+
+func (manager *LockManager) state(scope string) *lockScope {
+	state, ok := manager.scopes[scope]
+	if !ok {
+		state = &lockScope{name: scope, changed: make(chan struct{}), manager: manager}
+		manager.scopes[scope] = state
+	}
+	return state
+}
+
+func (manager *LockManager) notify(state *lockScope) {
+	if state.manager.fair {
+		state.grant()
+	}
+	close(state.changed)
+	state.changed = make(chan struct{})
+	if state.idle() {
+		delete(manager.scopes, state.name)
 	}
 }
@@ -0,0 +1,424 @@
+package queuerunner
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockManagerReadersShareScope(t *testing.T) {
+	manager := NewLockManager()
+	var inside, peak int32
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+
+	for index := 0; index < 3; index++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = manager.RunWithRLock("db", func() error {
+				current := atomic.AddInt32(&inside, 1)
+				for {
+					seen := atomic.LoadInt32(&peak)
+					if current <= seen || atomic.CompareAndSwapInt32(&peak, seen, current) {
+						break
+					}
+				}
+				<-release
+				atomic.AddInt32(&inside, -1)
+				return nil
+			})
+		}()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&inside) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !manager.IsLocked("db") {
+		t.Fatal("expected readers to hold the scope")
+	}
+	if err := manager.Lock("db"); err == nil {
+		t.Fatal("expected exclusive lock to fail while readers hold the scope")
+	}
+
+	close(release)
+	wg.Wait()
+
+	if atomic.LoadInt32(&peak) != 3 {
+		t.Fatalf("expected readers to run together, peak was %d", peak)
+	}
+	if manager.IsLocked("db") {
+		t.Fatal("expected scope to be free")
+	}
+}
+
+func TestLockManagerWriterWaitsForReaders(t *testing.T) {
+	manager := NewLockManager()
+	if err := manager.RLock("db"); err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan struct{})
+	go func() {
+		_ = manager.RunWithLock("db", func() error {
+			close(written)
+			return nil
+		})
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("writer ran while a reader held the scope")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	manager.RUnlock("db")
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("writer did not run after readers drained")
+	}
+}
+
+func TestLockManagerPrefersWaitingWriter(t *testing.T) {
+	manager := NewLockManager()
+	if err := manager.RLock("db"); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	order := []string{}
+	record := func(name string) func() error {
+		return func() error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return nil
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = manager.RunWithLock("db", record("writer"))
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for !manager.RLockBlocked("db") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := manager.RLock("db"); err == nil {
+		t.Fatal("expected a new reader to queue behind the waiting writer")
+	}
+
+	go func() {
+		defer wg.Done()
+		_ = manager.RunWithRLock("db", record("reader"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	manager.RUnlock("db")
+	wg.Wait()
+
+	if len(order) != 2 || order[0] != "writer" || order[1] != "reader" {
+		t.Fatalf("unexpected order: %v", order)
+	}
+}
+
+func TestLockManagerReleasesOnPanic(t *testing.T) {
+	manager := NewLockManager()
+
+	func() {
+		defer func() { _ = recover() }()
+		_ = manager.RunWithLock("db", func() error { panic("boom") })
+	}()
+
+	if manager.IsLocked("db") {
+		t.Fatal("expected panicking holder to release the scope")
+	}
+}
+
+func TestLockManagerSemaphoreCapacity(t *testing.T) {
+	manager := NewLockManager()
+	var inside, peak int32
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+
+	for index := 0; index < 6; index++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = manager.RunWithSemaphore(context.Background(), "browser", 4, func() error {
+				current := atomic.AddInt32(&inside, 1)
+				for {
+					seen := atomic.LoadInt32(&peak)
+					if current <= seen || atomic.CompareAndSwapInt32(&peak, seen, current) {
+						break
+					}
+				}
+				<-release
+				atomic.AddInt32(&inside, -1)
+				return nil
+			})
+		}()
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for manager.Semaphore("browser").Waiting < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := manager.Semaphore("browser"); stats != (SemaphoreStats{Capacity: 4, Holders: 4, Waiting: 2}) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if !manager.SemaphoreBlocked("browser", 4) {
+		t.Fatal("expected a full semaphore to block")
+	}
+
+	close(release)
+	wg.Wait()
+
+	if atomic.LoadInt32(&peak) != 4 {
+		t.Fatalf("expected at most 4 holders at once, peak was %d", peak)
+	}
+	if stats := manager.Semaphore("browser"); stats != (SemaphoreStats{}) {
+		t.Fatalf("expected scope to be released, got %+v", stats)
+	}
+}
+
+func TestLockManagerSemaphoreWaitIsCancellable(t *testing.T) {
+	manager := NewLockManager()
+	if err := manager.AcquireSemaphore(context.Background(), "browser", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ran := false
+	err := manager.RunWithSemaphore(ctx, "browser", 1, func() error {
+		ran = true
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || ran {
+		t.Fatalf("expected wait to time out, got %v", err)
+	}
+	if stats := manager.Semaphore("browser"); stats.Waiting != 0 || stats.Holders != 1 {
+		t.Fatalf("cancelled waiter left state behind: %+v", stats)
+	}
+
+	manager.ReleaseSemaphore("browser")
+	if manager.IsLocked("browser") {
+		t.Fatal("expected scope to be free")
+	}
+	if err := manager.AcquireSemaphore(context.Background(), "browser", 0); !errors.Is(err, ErrInvalidCapacity) {
+		t.Fatalf("expected ErrInvalidCapacity, got %v", err)
+	}
+}
+
+func TestLockManagerCancelledWriterUnblocksReaders(t *testing.T) {
+	manager := NewLockManager()
+	if err := manager.RLock("db"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := make(chan error, 1)
+	go func() { writer <- manager.LockContext(ctx, "db") }()
+
+	deadline := time.Now().Add(time.Second)
+	for !manager.RLockBlocked("db") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	reader := make(chan error, 1)
+	go func() { reader <- manager.RLockContext(context.Background(), "db") }()
+
+	cancel()
+	if err := <-writer; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancelled writer, got %v", err)
+	}
+	select {
+	case err := <-reader:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reader stayed blocked behind a cancelled writer")
+	}
+
+	manager.RUnlock("db")
+	manager.RUnlock("db")
+	if manager.IsLocked("db") || len(manager.scopes) != 0 {
+		t.Fatal("expected scope state to be cleaned up")
+	}
+}
+
+func TestLockManagerWaitContext(t *testing.T) {
+	manager := NewLockManager()
+	if err := manager.Lock("db"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if err := manager.WaitContext(ctx, "db"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected wait to time out, got %v", err)
+	}
+	if !manager.IsLocked("db") {
+		t.Fatal("expected holder to keep the scope")
+	}
+}
+
+func TestLockManagerWaitContextOutlastsPartialRelease(t *testing.T) {
+	manager := NewLockManager()
+	for _, acquire := range []func() error{
+		func() error { return manager.RLock("db") },
+		func() error { return manager.RLock("db") },
+		func() error { return manager.AcquireSemaphore(context.Background(), "pool", 2) },
+		func() error { return manager.AcquireSemaphore(context.Background(), "pool", 2) },
+	} {
+		if err := acquire(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, scope := range []string{"db", "pool"} {
+		waited := make(chan error, 1)
+		go func() { waited <- manager.Wait(scope) }()
+		time.Sleep(10 * time.Millisecond)
+
+		if scope == "db" {
+			manager.RUnlock(scope)
+		} else {
+			manager.ReleaseSemaphore(scope)
+		}
+		select {
+		case err := <-waited:
+			t.Fatalf("expected %s to be waited for while still held, got %v", scope, err)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		if scope == "db" {
+			manager.RUnlock(scope)
+		} else {
+			manager.ReleaseSemaphore(scope)
+		}
+		select {
+		case err := <-waited:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the wait for %s to end once it is free", scope)
+		}
+	}
+}
+
+func TestLockManagerTimeoutsDoNotLeakGoroutines(t *testing.T) {
+	manager := NewLockManager()
+	if err := manager.Lock("db"); err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+	for index := 0; index < 100; index++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		_ = manager.RunWithLockContext(ctx, "db", func() error { return nil })
+		cancel()
+	}
+	if grown := runtime.NumGoroutine() - before; grown > 10 {
+		t.Fatalf("expected cancelled waits not to leave goroutines, got %d", grown)
+	}
+
+	manager.Unlock("db")
+	if len(manager.scopes) != 0 {
+		t.Fatal("expected scope state to be cleaned up")
+	}
+}
+
+func TestLockManagerReentrantHoldCounts(t *testing.T) {
+	manager := NewLockManagerWithOpts(LockManagerOpts{Reentrant: true})
+	owner := ContextWithLockOwner(context.Background(), NewLockOwner("queue"))
+	other := ContextWithLockOwner(context.Background(), NewLockOwner("other"))
+
+	for index := 0; index < 3; index++ {
+		if err := manager.LockContext(owner, "db"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := manager.RLockContext(owner, "db"); err != nil {
+		t.Fatalf("expected an exclusive hold to cover a shared request, got %v", err)
+	}
+	if dump := manager.Dump(); dump != "db: held by [queue (exclusive x4)], waiting []\n" {
+		t.Fatalf("unexpected dump: %q", dump)
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- manager.LockContext(other, "db") }()
+
+	for index := 0; index < 4; index++ {
+		select {
+		case <-acquired:
+			t.Fatalf("other owner got the scope after %d of 4 releases", index)
+		case <-time.After(5 * time.Millisecond):
+		}
+		manager.Unlock("db")
+	}
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockManagerReentrancyDoesNotUpgrade(t *testing.T) {
+	manager := NewLockManagerWithOpts(LockManagerOpts{Reentrant: true})
+	owner := ContextWithLockOwner(context.Background(), NewLockOwner("queue"))
+
+	if err := manager.RLockContext(owner, "db"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.RLockContext(owner, "db"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.LockContext(owner, "db"); !errors.Is(err, ErrDeadlock) {
+		t.Fatalf("expected upgrading a shared hold to fail, got %v", err)
+	}
+}
+
+func TestReentrantLocksInQueue(t *testing.T) {
+	manager := NewLockManagerWithOpts(LockManagerOpts{Reentrant: true})
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}, LockingContext: manager})
+	recorder := &orderRecorder{}
+	inner := make(chan struct{})
+	release := make(chan struct{})
+
+	nested := WithLock("browser", func(ctx *Context) error {
+		return WithLocks([]string{"account:42", "browser"}, func(_ *Context) error {
+			close(inner)
+			<-release
+			return recorder.record("nested")()
+		})(ctx)
+	})
+	if err := runner.Add([]Action{nested}, map[string]any{}, "owner"); err != nil {
+		t.Fatal(err)
+	}
+	<-inner
+
+	if err := runner.Add([]Action{WithLock("browser", func(_ *Context) error {
+		return recorder.record("other")()
+	})}, map[string]any{}, "other"); err != nil {
+		t.Fatal(err)
+	}
+	waitQueued(t, manager, "browser", 1)
+
+	close(release)
+	waitIdle(t, runner)
+	recorder.expect(t, "nested", "other")
+	if manager.IsLocked("browser") || manager.IsLocked("account:42") {
+		t.Fatal("expected every hold to be released")
+	}
+}
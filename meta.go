@@ -0,0 +1,41 @@
+package queuerunner
+
+type Meta struct {
+	Name        string
+	Description string
+	Tags        []string
+}
+
+func Named(name string, action Action) Action {
+	return Describe(action, Meta{Name: name})
+}
+
+// Describe attaches metadata to action. Non-empty fields override the ones
+// already declared by the wrapped action and tags are added to its tags.
+func Describe(action Action, meta Meta) Action {
+	return wrapAction(action, func(ctx *Context) error {
+		return action(ctx)
+	}, func(info *actionInfo) {
+		if meta.Name != "" {
+			info.meta.Name = meta.Name
+		}
+		if meta.Description != "" {
+			info.meta.Description = meta.Description
+		}
+		if len(meta.Tags) > 0 {
+			info.meta.Tags = append(append([]string{}, info.meta.Tags...), meta.Tags...)
+		}
+	})
+}
+
+func MetaOf(action Action) Meta {
+	meta := describeAction(action).meta
+	meta.Name = actionName(action)
+	return meta
+}
+
+func nameAction(name string) func(info *actionInfo) {
+	return func(info *actionInfo) {
+		info.meta.Name = name
+	}
+}
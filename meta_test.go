@@ -0,0 +1,59 @@
+package queuerunner
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNamedSurvivesWrapping(t *testing.T) {
+	action := Describe(Named("fetch", func(_ *Context) error { return nil }), Meta{
+		Description: "downloads the page",
+		Tags:        []string{"network"},
+	})
+	wrapped := WithErrorHandler(WithDelay(WithLock("browser", action), time.Millisecond), nil)
+
+	meta := MetaOf(wrapped)
+	if meta.Name != "fetch" || meta.Description != "downloads the page" {
+		t.Fatalf("unexpected meta: %+v", meta)
+	}
+	if len(meta.Tags) != 1 || meta.Tags[0] != "network" {
+		t.Fatalf("unexpected tags: %v", meta.Tags)
+	}
+}
+
+func TestUnnamedWrappedActionReportsInnerFunction(t *testing.T) {
+	name := MetaOf(WithLock("browser", anyAction(func(_ *Context) error { return nil }))).Name
+
+	if strings.Contains(name, "wrapAction") || !strings.Contains(name, "TestUnnamedWrappedActionReportsInnerFunction") {
+		t.Fatalf("expected inner function name, got %q", name)
+	}
+}
+
+func TestQueueLogsUseActionNames(t *testing.T) {
+	logger := &testLogger{}
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			Named("prepare", func(_ *Context) error { return nil }),
+			Util.If(func(_ *Context) (bool, error) { return true, nil }, Branches{
+				Then: []Action{WithLock("browser", Named("render", func(_ *Context) error { return nil }))},
+			}),
+			Util.Delay(0),
+		},
+		Name:   "TestQueue",
+		Logger: logger,
+	})
+
+	queue.Run(map[string]any{})
+
+	expected := []string{"prepare", "Util.If", "render", "Util.Delay(0s)"}
+	contexts := logger.Contexts()
+	if len(contexts) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, contexts)
+	}
+	for i := range expected {
+		if contexts[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, contexts)
+		}
+	}
+}
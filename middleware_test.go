@@ -0,0 +1,86 @@
+package queuerunner
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func tracingMiddleware(mu *sync.Mutex, trace *[]string, tag string) Middleware {
+	return func(next Action) Action {
+		return func(ctx *Context) error {
+			mu.Lock()
+			*trace = append(*trace, tag+">"+MetaOf(next).Name)
+			mu.Unlock()
+			return next(ctx)
+		}
+	}
+}
+
+func TestQueueMiddlewareWrapsPushedActions(t *testing.T) {
+	var mu sync.Mutex
+	trace := []string{}
+
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			Util.If(func(_ *Context) (bool, error) { return true, nil }, Branches{
+				Then: []Action{Named("then", func(ctx *Context) error {
+					ctx.Push([]Action{Named("pushed", func(_ *Context) error { return nil })})
+					return nil
+				})},
+			}),
+		},
+		Name:   "TestQueue",
+		Logger: &testLogger{},
+		Middleware: []Middleware{
+			tracingMiddleware(&mu, &trace, "outer"),
+			tracingMiddleware(&mu, &trace, "inner"),
+		},
+	})
+
+	queue.Run(map[string]any{})
+
+	expected := []string{
+		"outer>Util.If", "inner>Util.If",
+		"outer>then", "inner>then",
+		"outer>pushed", "inner>pushed",
+	}
+	if len(trace) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, trace)
+	}
+	for i := range expected {
+		if trace[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, trace)
+		}
+	}
+}
+
+func TestRunnerMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	trace := []string{}
+	done := make(chan struct{})
+
+	runner := NewQueueRunner(RunnerOpts{
+		Logger:     &testLogger{},
+		Middleware: []Middleware{tracingMiddleware(&mu, &trace, "runner")},
+	})
+	runner.AddEndListener(func(_ string, size int) {
+		if size == 0 {
+			close(done)
+		}
+	})
+
+	runner.Add([]Action{Named("only", func(_ *Context) error { return nil })}, map[string]any{}, "")
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for queue")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(trace) != 1 || trace[0] != "runner>only" {
+		t.Fatalf("unexpected trace: %v", trace)
+	}
+}
@@ -0,0 +1,116 @@
+package queuerunner
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// MultiLockingContext is implemented by locking contexts that take several
+// scopes at once. WithLocks falls back to polling Lock on every scope when
+// the queue's locking context does not implement it.
+type MultiLockingContext interface {
+	LockingContext
+	RunWithLocks(scopes []string, fn func() error) error
+}
+
+type multiContextLocking interface {
+	RunWithLocksContext(ctx context.Context, scopes []string, fn func() error) error
+}
+
+// LockAllContext takes every scope exclusively or none of them. While it
+// waits no scope is held, so requests for overlapping sets of scopes cannot
+// deadlock whatever order they name them in.
+func (manager *LockManager) LockAllContext(ctx context.Context, scopes []string) error {
+	canonical, err := canonicalScopes(scopes)
+	if err != nil {
+		return err
+	}
+	_, err = manager.acquire(ctx, canonical, exclusiveLock, 0)
+	return err
+}
+
+func (manager *LockManager) UnlockAll(scopes []string) {
+	for _, scope := range scopes {
+		manager.Unlock(scope)
+	}
+}
+
+func (manager *LockManager) RunWithLocks(scopes []string, fn func() error) error {
+	return manager.RunWithLocksContext(context.Background(), scopes, fn)
+}
+
+func (manager *LockManager) RunWithLocksContext(ctx context.Context, scopes []string, fn func() error) error {
+	canonical, err := canonicalScopes(scopes)
+	if err != nil {
+		return err
+	}
+	return manager.runWith(ctx, canonical, exclusiveLock, 0, fn)
+}
+
+// canonicalScopes validates the scopes and returns them sorted without
+// duplicates, the one order every multi-scope request uses.
+func canonicalScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, ErrInvalidScope
+	}
+
+	canonical := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		if err := ValidateScope(scope); err != nil {
+			return nil, err
+		}
+		canonical = append(canonical, scope)
+	}
+	sort.Strings(canonical)
+
+	unique := canonical[:1]
+	for _, scope := range canonical[1:] {
+		if scope != unique[len(unique)-1] {
+			unique = append(unique, scope)
+		}
+	}
+	return unique, nil
+}
+
+// runWithLocks takes all scopes through the locking context. One that only
+// knows single scopes gets them tried in canonical order; when one is
+// taken, the rest are released and tried again later instead of being held
+// while it waits.
+func runWithLocks(ctx context.Context, locking LockingContext, scopes []string, fn func() error) error {
+	if multi, ok := locking.(multiContextLocking); ok {
+		return multi.RunWithLocksContext(ctx, scopes, fn)
+	}
+	if multi, ok := locking.(MultiLockingContext); ok {
+		return multi.RunWithLocks(scopes, fn)
+	}
+
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for !tryLockAll(locking, scopes) {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer func() {
+		for _, scope := range scopes {
+			locking.Unlock(scope)
+		}
+	}()
+
+	return fn()
+}
+
+func tryLockAll(locking LockingContext, scopes []string) bool {
+	for index, scope := range scopes {
+		if locking.Lock(scope) != nil {
+			for _, taken := range scopes[:index] {
+				locking.Unlock(taken)
+			}
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+package queuerunner
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunWithLocksOppositeOrdersDoNotDeadlock(t *testing.T) {
+	for _, ordering := range []LockOrdering{LockFIFO, LockRacing} {
+		manager := NewLockManagerWithOpts(LockManagerOpts{Ordering: ordering})
+		var inside [2]int32
+		var wg sync.WaitGroup
+		done := make(chan struct{})
+
+		orders := [][]string{{"browser", "account:42"}, {"account:42", "browser"}, {"browser"}}
+		for index := 0; index < 12; index++ {
+			scopes := orders[index%len(orders)]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for turn := 0; turn < 50; turn++ {
+					_ = manager.RunWithLocks(scopes, func() error {
+						for _, scope := range scopes {
+							slot := &inside[0]
+							if scope == "account:42" {
+								slot = &inside[1]
+							}
+							if atomic.AddInt32(slot, 1) != 1 {
+								t.Errorf("two holders inside %q", scope)
+							}
+							defer atomic.AddInt32(slot, -1)
+						}
+						return nil
+					})
+				}
+			}()
+		}
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ordering %d: multi-scope holders deadlocked", ordering)
+		}
+		if len(manager.scopes) != 0 {
+			t.Fatalf("ordering %d: expected scope state to be cleaned up", ordering)
+		}
+	}
+}
+
+func TestRunWithLocksHoldsNothingWhileWaiting(t *testing.T) {
+	manager := NewLockManagerWithOpts(LockManagerOpts{Ordering: LockRacing})
+	if err := manager.Lock("account:42"); err != nil {
+		t.Fatal(err)
+	}
+
+	ran := make(chan struct{})
+	go func() {
+		_ = manager.RunWithLocks([]string{"browser", "account:42"}, func() error {
+			close(ran)
+			return nil
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if manager.IsLocked("browser") {
+		t.Fatal("expected the free scope not to be held while waiting for the other")
+	}
+	if err := manager.Lock("browser"); err != nil {
+		t.Fatalf("expected the free scope to stay usable: %v", err)
+	}
+	manager.Unlock("browser")
+
+	manager.Unlock("account:42")
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("expected both scopes to be taken once free")
+	}
+}
+
+func TestLockManagerQueuesMultiScopeRequests(t *testing.T) {
+	manager := NewLockManager()
+	if err := manager.Lock("account:42"); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &orderRecorder{}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_ = manager.RunWithLocks([]string{"browser", "account:42"}, recorder.record("both"))
+	}()
+	waitQueued(t, manager, "browser", 1)
+	if manager.IsLocked("browser") {
+		t.Fatal("expected the free scope not to be held while waiting for the other")
+	}
+
+	go func() {
+		defer wg.Done()
+		_ = manager.RunWithLock("browser", recorder.record("browser"))
+	}()
+	waitQueued(t, manager, "browser", 2)
+
+	manager.Unlock("account:42")
+	wg.Wait()
+	recorder.expect(t, "both", "browser")
+}
+
+func TestWithLocks(t *testing.T) {
+	manager := NewLockManager()
+	for _, locking := range []LockingContext{manager, exclusiveOnly{manager}} {
+		var held bool
+		action := WithLocks([]string{"b", "a", "b"}, func(_ *Context) error {
+			held = manager.IsLocked("a") && manager.IsLocked("b")
+			return nil
+		})
+		if err := action(&Context{locking: locking}); err != nil || !held {
+			t.Fatalf("expected both scopes to be held, got %v", err)
+		}
+		if manager.IsLocked("a") || manager.IsLocked("b") {
+			t.Fatal("expected scopes to be released")
+		}
+	}
+
+	if err := WithLocks(nil, func(_ *Context) error { return nil })(&Context{}); !errors.Is(err, ErrInvalidScope) {
+		t.Fatalf("expected ErrInvalidScope, got %v", err)
+	}
+	if err := WithLocks([]string{"a", " "}, func(_ *Context) error { return nil })(&Context{}); !errors.Is(err, ErrInvalidScope) {
+		t.Fatalf("expected ErrInvalidScope, got %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package queuerunner
+
+import (
+	"sync"
+	"time"
+)
+
+const stepsPerTurn = 8
+
+// workerPool runs queues on at most a fixed number of workers. Workers are
+// started when queues become ready and exit when there is nothing left to
+// run, so an idle pool holds no goroutines. A queue holds a worker only
+// while one of its actions executes: delays park it on a timer. A queue
+// that blocks while running an action, for example waiting for a lock,
+// detaches from the pool and gives its worker slot up, though it keeps its
+// goroutine while it waits. To go on it waits for a slot, so no more
+// actions run at once than there are workers.
+type workerPool struct {
+	mu        sync.Mutex
+	size      int
+	workers   int
+	ready     []*Queue
+	head      int
+	rejoining []chan struct{}
+}
+
+func newWorkerPool(workers int) *workerPool {
+	return &workerPool{size: workers}
+}
+
+func (pool *workerPool) run(queue *Queue, initial map[string]any) {
+	queue.pool = pool
+	if !queue.start(initial) {
+		queue.finish()
+		return
+	}
+	pool.submit(queue)
+}
+
+func (pool *workerPool) submit(queue *Queue) {
+	pool.mu.Lock()
+	pool.ready = append(pool.ready, queue)
+	spawn := pool.grow()
+	pool.mu.Unlock()
+
+	if spawn {
+		go pool.work()
+	}
+}
+
+// next returns the next queue to run, or nil when the worker is to exit:
+// either nothing is ready or a detached queue waits for the worker's slot.
+func (pool *workerPool) next() *Queue {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if len(pool.rejoining) > 0 || pool.head == len(pool.ready) {
+		pool.release()
+		return nil
+	}
+
+	queue := pool.ready[pool.head]
+	pool.ready[pool.head] = nil
+	pool.head++
+
+	if pool.head == len(pool.ready) {
+		pool.ready = pool.ready[:0]
+		pool.head = 0
+	} else if pool.head >= 1024 && pool.head*2 >= len(pool.ready) {
+		count := copy(pool.ready, pool.ready[pool.head:])
+		clear(pool.ready[count:])
+		pool.ready = pool.ready[:count]
+		pool.head = 0
+	}
+	return queue
+}
+
+// grow takes a free slot for a new worker when queues are waiting to run.
+// It is called with mu held.
+func (pool *workerPool) grow() bool {
+	if pool.workers >= pool.size || pool.head == len(pool.ready) {
+		return false
+	}
+	pool.workers++
+	return true
+}
+
+// release gives up a worker slot, handing it to a detached queue waiting
+// to go on if there is one. It is called with mu held.
+func (pool *workerPool) release() {
+	if len(pool.rejoining) > 0 {
+		close(pool.rejoining[0])
+		pool.rejoining[0] = nil
+		pool.rejoining = pool.rejoining[1:]
+		return
+	}
+	pool.workers--
+}
+
+func (pool *workerPool) work() {
+	for queue := pool.next(); queue != nil; queue = pool.next() {
+		pool.turn(queue)
+	}
+}
+
+// detach gives up the calling worker's slot, starting a new worker if
+// queues are ready, and returns the function that waits for a slot again.
+func (pool *workerPool) detach() func() {
+	pool.mu.Lock()
+	pool.release()
+	spawn := pool.grow()
+	pool.mu.Unlock()
+
+	if spawn {
+		go pool.work()
+	}
+	return pool.rejoin
+}
+
+func (pool *workerPool) rejoin() {
+	pool.mu.Lock()
+	if pool.workers < pool.size {
+		pool.workers++
+		pool.mu.Unlock()
+		return
+	}
+	slot := make(chan struct{})
+	pool.rejoining = append(pool.rejoining, slot)
+	pool.mu.Unlock()
+
+	<-slot
+}
+
+func (pool *workerPool) turn(queue *Queue) {
+	for budget := stepsPerTurn; budget > 0; budget-- {
+		more := queue.step()
+		if !more || queue.parked > 0 {
+			pool.resume(queue, more)
+			return
+		}
+	}
+
+	pool.submit(queue)
+}
+
+func (pool *workerPool) resume(queue *Queue, more bool) {
+	proceed := func() {
+		if more {
+			pool.submit(queue)
+		} else {
+			queue.finish()
+		}
+	}
+
+	delay := queue.parked
+	queue.parked = 0
+	if delay > 0 {
+		time.AfterFunc(delay, proceed)
+		return
+	}
+	proceed()
+}
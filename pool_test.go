@@ -0,0 +1,277 @@
+package queuerunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolRunnerParksDelayedQueues(t *testing.T) {
+	var mu sync.Mutex
+	order := []string{}
+	done := make(chan struct{})
+	record := func(name string) Action {
+		return anyAction(func(_ *Context) error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}, Workers: 1})
+	runner.AddEndListener(func(_ string, size int) {
+		if size == 0 {
+			close(done)
+		}
+	})
+
+	runner.Add([]Action{Util.Delay(10 * time.Millisecond), record("second")}, map[string]any{}, "")
+	runner.Add([]Action{record("first"), WithDelay(record("delayed"), 20*time.Millisecond), record("third")}, map[string]any{}, "")
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for queues")
+	}
+
+	expected := []string{"first", "delayed", "second", "third"}
+	if len(order) != len(expected) {
+		t.Fatalf("unexpected order: %v", order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("unexpected order: %v", order)
+		}
+	}
+}
+
+func TestPoolRunnerLockWaitDoesNotHoldWorker(t *testing.T) {
+	release := make(chan struct{})
+	var finished int32
+	done := make(chan struct{})
+
+	// The holder keeps one worker busy; the waiter must leave the other one
+	// to the releaser while it waits.
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}, Workers: 2})
+	runner.AddEndListener(func(_ string, size int) {
+		if size == 0 {
+			close(done)
+		}
+	})
+
+	holder := WithLock("browser", func(_ *Context) error {
+		<-release
+		atomic.AddInt32(&finished, 1)
+		return nil
+	})
+	waiter := WithLock("browser", func(_ *Context) error {
+		atomic.AddInt32(&finished, 1)
+		return nil
+	})
+
+	runner.Add([]Action{holder}, map[string]any{}, "holder")
+	runner.Add([]Action{waiter}, map[string]any{}, "waiter")
+	runner.Add([]Action{Util.Delay(5 * time.Millisecond), anyAction(func(_ *Context) error {
+		close(release)
+		return nil
+	})}, map[string]any{}, "releaser")
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiting for the lock held a worker")
+	}
+
+	if atomic.LoadInt32(&finished) != 2 {
+		t.Fatalf("expected both lock holders to run, got %d", finished)
+	}
+}
+
+func TestPoolRunnerManyIdleQueues(t *testing.T) {
+	const queues = 2000
+	var completed int32
+	done := make(chan struct{})
+
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}, Workers: 4})
+	runner.AddEndListener(func(_ string, _ int) {
+		if atomic.AddInt32(&completed, 1) == queues {
+			close(done)
+		}
+	})
+
+	before := runtime.NumGoroutine()
+	for index := 0; index < queues; index++ {
+		runner.Add([]Action{Util.Delay(500 * time.Millisecond), Util.Delay(0)}, map[string]any{}, "")
+	}
+
+	if grown := runtime.NumGoroutine() - before; grown > queues/10 {
+		t.Fatalf("expected parked queues not to hold goroutines, got %d new goroutines", grown)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout, %d queues completed", atomic.LoadInt32(&completed))
+	}
+}
+
+func TestPoolRunnerDelayKeepsLockHeld(t *testing.T) {
+	var mu sync.Mutex
+	order := []string{}
+	record := func(name string) Action {
+		return anyAction(func(_ *Context) error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return nil
+		})
+	}
+	done := make(chan struct{})
+
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}, Workers: 2})
+	runner.AddEndListener(func(_ string, size int) {
+		if size == 0 {
+			close(done)
+		}
+	})
+
+	runner.Add([]Action{WithLock("x", WithDelay(record("a-in"), 100*time.Millisecond)), record("a-after")}, map[string]any{}, "a")
+	runner.Add([]Action{Util.Delay(20 * time.Millisecond), WithLock("x", record("b-in"))}, map[string]any{}, "b")
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for queues")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 3 || order[0] != "a-in" || order[2] != "b-in" {
+		t.Fatalf("expected the lock to be held for the whole delay, got %v", order)
+	}
+}
+
+func TestPoolRunnerCapsLockedActions(t *testing.T) {
+	var running, peak int32
+	done := make(chan struct{})
+
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}, Workers: 2})
+	var ended int32
+	runner.AddEndListener(func(_ string, _ int) {
+		if atomic.AddInt32(&ended, 1) == 6 {
+			close(done)
+		}
+	})
+
+	busy := anyAction(func(_ *Context) error {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			seen := atomic.LoadInt32(&peak)
+			if current <= seen || atomic.CompareAndSwapInt32(&peak, seen, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	})
+	// Three queues wait for a nested lock while holding their own, which
+	// must neither stall the pool nor lift the cap.
+	for index := 0; index < 6; index++ {
+		action := WithLock(fmt.Sprintf("own-%d", index), busy)
+		if index%2 == 0 {
+			action = WithLock(fmt.Sprintf("own-%d", index), WithLock("shared", busy))
+		}
+		runner.Add([]Action{action}, map[string]any{}, "")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nested lock waits stalled the pool")
+	}
+	if got := atomic.LoadInt32(&peak); got > 2 {
+		t.Fatalf("expected at most 2 locked actions at once, got %d", got)
+	}
+}
+
+func TestPoolRunnerCloseLeavesNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}, Workers: 4})
+	for i := 0; i < 20; i++ {
+		runner.Add([]Action{
+			WithLock("shared", func(_ *Context) error { return nil }),
+			Util.Delay(time.Millisecond),
+			anyAction(func(_ *Context) error { return nil }),
+		}, map[string]any{}, "")
+	}
+	if _, err := runner.AddAfter(time.Hour, []Action{anyAction(func(_ *Context) error { return nil })}, map[string]any{}, "later"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Register("job", func() []Action { return []Action{anyAction(func(_ *Context) error { return nil })} }, TemplateOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runner.Schedule("0 * * * *", "job", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := runner.WaitIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+	runner.Close()
+	if err := runner.Add([]Action{anyAction(func(_ *Context) error { return nil })}, map[string]any{}, ""); !errors.Is(err, ErrRunnerClosed) {
+		t.Fatalf("expected ErrRunnerClosed, got %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("expected at most %d goroutines after Close, got %d", before, after)
+	}
+}
+
+func TestLockedActionDetachesOnlyWhenItWaits(t *testing.T) {
+	for _, ordering := range []LockOrdering{LockFIFO, LockRacing} {
+		locking := NewLockManagerWithOpts(LockManagerOpts{Ordering: ordering})
+		var detached int32
+		queue := NewQueue(QueueOpts{
+			Actions: []Action{
+				WithLock("free", func(_ *Context) error { return nil }),
+				WithLock("busy", func(_ *Context) error { return nil }),
+			},
+			Logger:         &testLogger{},
+			LockingContext: locking,
+		})
+		queue.context.detachFn = func() func() {
+			atomic.AddInt32(&detached, 1)
+			return func() {}
+		}
+
+		locking.Lock("busy")
+		results := make(chan RunResult, 1)
+		go func() { results <- queue.Run(map[string]any{}) }()
+		deadline := time.Now().Add(2 * time.Second)
+		for atomic.LoadInt32(&detached) == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		locking.Unlock("busy")
+
+		if result := <-results; result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		if count := atomic.LoadInt32(&detached); count != 1 {
+			t.Fatalf("ordering %d: expected one detach for the busy scope, got %d", ordering, count)
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package queuerunner
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"runtime"
+	"time"
 )
 
 type QueueOpts struct {
@@ -13,16 +15,55 @@ type QueueOpts struct {
 	Logger         Logger
 	LockingContext LockingContext
 	OnError        ErrorHandler
+	MaxJumps       int
+	Limits         Limits
+	Middleware     []Middleware
 }
 
 type Queue struct {
 	name        string
-	queue       []Action
+	actions     []Action
+	queue       *stepDeque
 	end         func()
 	logger      Logger
 	lockManager LockingContext
 	context     *Context
 	onError     ErrorHandler
+	requires    []requiredKey
+	invalid     error
+	failure     error
+	fatal       error
+	aborted     bool
+	undo        []*compensation
+	maxJumps    int
+	jumps       int
+	limits      Limits
+	steps       int
+	depth       int
+	history     []string
+	exceeded    error
+	started     time.Time
+	cancelRun   context.CancelFunc
+	pool        *workerPool
+	parked      time.Duration
+	middleware  []Middleware
+	events      *eventBus
+	runnerBus   *eventBus
+	template    *queueTemplate
+	done        func()
+	held        []string
+}
+
+type queueStep struct {
+	action Action
+	depth  int
+}
+
+type RunResult struct {
+	Name          string
+	Err           error
+	Aborted       bool
+	Compensations []CompensationResult
 }
 
 func NewQueue(opts QueueOpts) *Queue {
@@ -33,11 +74,16 @@ func NewQueue(opts QueueOpts) *Queue {
 
 	queue := &Queue{
 		name:        queueName,
-		queue:       append([]Action{}, opts.Actions...),
+		actions:     append([]Action{}, opts.Actions...),
+		queue:       newStepDeque(opts.Actions),
 		end:         opts.End,
 		logger:      opts.Logger,
 		lockManager: opts.LockingContext,
 		onError:     opts.OnError,
+		maxJumps:    opts.MaxJumps,
+		limits:      opts.Limits,
+		middleware:  append([]Middleware{}, opts.Middleware...),
+		events:      &eventBus{},
 	}
 
 	if queue.end == nil {
@@ -52,55 +98,194 @@ func NewQueue(opts QueueOpts) *Queue {
 	if queue.onError == nil {
 		queue.onError = defaultErrorHandler
 	}
+	if queue.maxJumps <= 0 {
+		queue.maxJumps = DefaultMaxJumps
+	}
+
+	queue.requires, queue.invalid = analyzeActions(queue.actions)
 
 	queue.context = newContext(queue.Push, func() string { return queue.name }, queue.Abort, queue.lockManager)
+	queue.context.compensateFn = queue.addCompensation
+	queue.context.appendFn = queue.Append
+	queue.context.insertAfterFn = queue.InsertAfter
+	queue.context.remainingFn = queue.Remaining
+	queue.context.goToFn = queue.GoTo
+	queue.context.skipUntilFn = queue.SkipUntil
+	queue.context.restartFn = queue.Restart
+	queue.context.sleepFn = queue.sleep
+	queue.context.emitFn = queue.emit
+	queue.context.acquireLockFn = queue.acquireLock
+	queue.context.releaseLockFn = queue.releaseLock
+	queue.context.detachFn = queue.detach
+	queue.context.owner = NewLockOwner(queueName)
 
 	return queue
 }
 
-func (queue *Queue) Run(initial map[string]any) {
+func (queue *Queue) Run(initial map[string]any) RunResult {
+	if queue.start(initial) {
+		for queue.step() {
+		}
+	}
+	return queue.finish()
+}
+
+func (queue *Queue) start(initial map[string]any) bool {
 	if initial == nil {
 		initial = map[string]any{}
 	}
 
 	queue.context.Initialize(initial)
+	queue.started = time.Now()
+	if queue.limits.MaxRunTime > 0 {
+		queue.context.current, queue.cancelRun = context.WithTimeout(context.Background(), queue.limits.MaxRunTime)
+	}
+	queue.emit(func(info EventInfo) Event {
+		return QueueStarted{EventInfo: info}
+	})
 
-	defer func() {
-		queue.end()
-	}()
+	if err := queue.Validate(initial); err != nil {
+		queue.logger.Info(fmt.Sprintf("Queue(%s): invalid pipeline", queue.name))
+		queue.fail(err)
+		queue.handleError(err)
+		return false
+	}
+
+	return true
+}
 
+// step runs the next action and reports whether more actions remain.
+func (queue *Queue) step() (more bool) {
 	defer func() {
 		if recovered := recover(); recovered != nil {
 			queue.logger.Info(fmt.Sprintf("Queue(%s) failed", queue.name))
-			if err, ok := recovered.(error); ok {
-				queue.logger.Error(err)
-			} else {
-				queue.logger.Error(fmt.Errorf("%v", recovered))
+			err, ok := recovered.(error)
+			if !ok {
+				err = fmt.Errorf("%v", recovered)
 			}
+			queue.logger.Error(err)
+			queue.fail(err)
+			queue.Abort()
+			more = false
 		}
 	}()
 
-	for {
-		if len(queue.queue) == 0 {
-			queue.logger.Info(fmt.Sprintf("Queue(%s): stopped", queue.name))
-			break
+	if queue.queue.Len() == 0 {
+		return false
+	}
+	if queue.checkLimits(queue.started) != nil {
+		return false
+	}
+
+	step, _ := queue.queue.popFront()
+	queue.depth = step.depth
+	action := step.action
+
+	name := actionName(action)
+	queue.remember(name)
+	queue.context.action = name
+	queue.logger.SetContext(name)
+	queue.logger.Info(fmt.Sprintf("Queue(%s): running action", queue.name))
+
+	if err := queue.execute(action); err != nil {
+		// An action that gave up because the run time ran out reports the
+		// limit rather than its own error.
+		if queue.overran() {
+			queue.exceed(LimitMaxRunTime, queue.limits.MaxRunTime)
+			return false
 		}
+		queue.handleError(err)
+	}
 
-		action := queue.queue[0]
-		queue.queue = queue.queue[1:]
+	return queue.queue.Len() > 0
+}
+
+func (queue *Queue) execute(action Action) error {
+	if !queue.observed() {
+		_, err := queue.executeSafe(action)
+		return err
+	}
 
-		queue.logger.SetContext(actionName(action))
-		queue.logger.Info(fmt.Sprintf("Queue(%s): running action", queue.name))
+	meta := MetaOf(action)
+	queue.emit(func(info EventInfo) Event {
+		return ActionStarted{EventInfo: info, Action: meta}
+	})
 
-		if err := queue.executeSafe(action); err != nil {
-			queue.handleError(err)
+	started := time.Now()
+	recovered, err := queue.executeSafe(action)
+	duration := time.Since(started)
+
+	queue.emit(func(info EventInfo) Event {
+		switch {
+		case recovered != nil:
+			return ActionPanicked{EventInfo: info, Action: meta, Value: recovered}
+		case err != nil:
+			return ActionFailed{EventInfo: info, Action: meta, Err: err, Duration: duration}
+		default:
+			return ActionSucceeded{EventInfo: info, Action: meta, Duration: duration}
 		}
+	})
+
+	return err
+}
+
+func (queue *Queue) finish() RunResult {
+	defer func() {
+		queue.end()
+	}()
+
+	queue.logger.Info(fmt.Sprintf("Queue(%s): stopped", queue.name))
+	queue.releaseLocks()
+	if queue.cancelRun != nil {
+		queue.cancelRun()
+	}
+
+	result := RunResult{Name: queue.name, Err: queue.failure, Aborted: queue.aborted}
+	if queue.failure != nil || queue.aborted {
+		result.Compensations = queue.compensate()
 	}
+
+	queue.emit(func(info EventInfo) Event {
+		return QueueEnded{EventInfo: info, Result: result}
+	})
+	return result
 }
 
-func (queue *Queue) executeSafe(action Action) (err error) {
+// sleep blocks the queue for delay. Queues driven by a worker pool only
+// record the delay and are parked once the running action returns, unless
+// they hold a lock: parking would let the lock go before the delay is over,
+// so they sleep for real and only give up their worker meanwhile.
+func (queue *Queue) sleep(delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+	if queue.pool != nil && queue.context.locked == 0 && len(queue.held) == 0 {
+		queue.parked += delay
+		return
+	}
+	defer queue.detach()()
+	time.Sleep(delay)
+}
+
+// detach gives up the worker of a queue driven by a worker pool while the
+// queue blocks, and returns the function that waits for a worker again.
+func (queue *Queue) detach() func() {
+	if queue.pool == nil {
+		return func() {}
+	}
+	return queue.pool.detach()
+}
+
+func (queue *Queue) Validate(initial map[string]any) error {
+	if queue.invalid != nil {
+		return queue.invalid
+	}
+	return checkRequired(queue.requires, initial)
+}
+
+func (queue *Queue) executeSafe(action Action) (recovered any, err error) {
 	defer func() {
-		if recovered := recover(); recovered != nil {
+		if recovered = recover(); recovered != nil {
 			if recoveredErr, ok := recovered.(error); ok {
 				err = recoveredErr
 			} else {
@@ -109,10 +294,43 @@ func (queue *Queue) executeSafe(action Action) (err error) {
 		}
 	}()
 
-	return action(queue.context)
+	return nil, queue.applyMiddleware(action)(queue.context)
+}
+
+// applyMiddleware wraps action so that the first middleware is the outermost
+// one. Every layer keeps the metadata of the original action.
+func (queue *Queue) applyMiddleware(action Action) Action {
+	for index := len(queue.middleware) - 1; index >= 0; index-- {
+		if wrapped := queue.middleware[index](action); wrapped != nil {
+			action = wrapAction(action, wrapped, nil)
+		}
+	}
+	return action
+}
+
+// fail records err as the error that stopped the run.
+func (queue *Queue) fail(err error) {
+	if queue.failure == nil {
+		queue.failure = err
+	}
+	if queue.fatal == nil {
+		queue.fatal = err
+	}
 }
 
+// handleError passes err to the error handler. The error stops the run only
+// if the handler aborts the queue; otherwise the queue goes on with it
+// recovered.
 func (queue *Queue) handleError(err error) {
+	if queue.failure == nil {
+		queue.failure = err
+	}
+
+	defer func() {
+		if queue.aborted && queue.fatal == nil {
+			queue.fatal = err
+		}
+	}()
 	defer func() {
 		if recovered := recover(); recovered != nil {
 			queue.logger.Info(fmt.Sprintf("Queue(%s) onError failed", queue.name))
@@ -129,15 +347,53 @@ func (queue *Queue) handleError(err error) {
 }
 
 func (queue *Queue) Push(actions []Action) {
-	if len(actions) == 0 {
+	depth, ok := queue.pushDepth(actions)
+	if !ok {
+		return
+	}
+
+	queue.queue.pushFront(actions, depth)
+	queue.emitPushed(actions)
+	queue.checkLength()
+}
+
+func (queue *Queue) Append(actions []Action) {
+	depth, ok := queue.pushDepth(actions)
+	if !ok {
 		return
 	}
 
-	queue.queue = append(actions, queue.queue...)
+	queue.queue.pushBack(actions, depth)
+	queue.emitPushed(actions)
+	queue.checkLength()
+}
+
+func (queue *Queue) InsertAfter(label string, actions []Action) error {
+	index := queue.indexOfRemaining(label)
+	if index < 0 {
+		return fmt.Errorf("%w: %q", ErrLabelNotFound, label)
+	}
+	depth, ok := queue.pushDepth(actions)
+	if !ok {
+		return nil
+	}
+
+	queue.queue.insert(index+1, actions, depth)
+	queue.emitPushed(actions)
+	queue.checkLength()
+	return nil
+}
+
+func (queue *Queue) Remaining() []Action {
+	return queue.queue.actions()
 }
 
 func (queue *Queue) Abort() {
-	queue.queue = queue.queue[:0]
+	queue.aborted = true
+	queue.queue.clear()
+	queue.emit(func(info EventInfo) Event {
+		return Aborted{EventInfo: info}
+	})
 }
 
 func actionName(action Action) string {
@@ -145,6 +401,14 @@ func actionName(action Action) string {
 		return "unknown"
 	}
 
+	info := describeAction(action)
+	if info.meta.Name != "" {
+		return info.meta.Name
+	}
+	if info.origin != nil {
+		action = info.origin
+	}
+
 	fn := runtime.FuncForPC(reflect.ValueOf(action).Pointer())
 	if fn == nil {
 		return "action"
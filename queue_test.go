@@ -1,6 +1,7 @@
 package queuerunner
 
 import (
+	"errors"
 	"sync"
 	"testing"
 	"time"
@@ -288,3 +289,70 @@ func TestWithErrorHandlerContinuesQueue(t *testing.T) {
 		t.Fatalf("unexpected order: %v", order)
 	}
 }
+
+func TestContextAppendAndInsertAfter(t *testing.T) {
+	order := []string{}
+	record := func(name string) Action {
+		return anyAction(func(_ *Context) error { order = append(order, name); return nil })
+	}
+	var insertErr error
+	remaining := 0
+
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			anyAction(func(ctx *Context) error {
+				remaining = len(ctx.Remaining())
+				ctx.Append([]Action{record("appended")})
+				insertErr = ctx.InsertAfter("fetch", []Action{record("inserted")})
+				return nil
+			}),
+			Label("fetch", record("fetch")),
+			record("publish"),
+		},
+		Name:   "TestQueue",
+		Logger: &testLogger{},
+	})
+
+	queue.Run(map[string]any{})
+
+	if insertErr != nil {
+		t.Fatalf("unexpected insert error: %v", insertErr)
+	}
+	if remaining != 2 {
+		t.Fatalf("expected 2 remaining actions, got %d", remaining)
+	}
+	expected := []string{"fetch", "inserted", "publish", "appended"}
+	if len(order) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, order)
+		}
+	}
+}
+
+func TestContextInsertAfterUnknownLabel(t *testing.T) {
+	var insertErr error
+	queue := NewQueue(QueueOpts{
+		Actions: []Action{
+			anyAction(func(ctx *Context) error {
+				insertErr = ctx.InsertAfter("missing", []Action{Util.Abort})
+				ctx.Remaining()[0] = nil
+				return nil
+			}),
+			Label("present", anyAction(func(_ *Context) error { return nil })),
+		},
+		Name:   "TestQueue",
+		Logger: &testLogger{},
+	})
+
+	result := queue.Run(map[string]any{})
+
+	if !errors.Is(insertErr, ErrLabelNotFound) {
+		t.Fatalf("expected ErrLabelNotFound, got %v", insertErr)
+	}
+	if result.Err != nil {
+		t.Fatalf("expected Remaining to be a copy, got %v", result.Err)
+	}
+}
@@ -1,33 +1,72 @@
 package queuerunner
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
 )
 
+var ErrRunnerClosed = errors.New("queue runner is closed")
+
 type RunnerOpts struct {
-	Logger Logger
+	Logger         Logger
+	Workers        int
+	Middleware     []Middleware
+	AsyncListeners bool
+	Clock          Clock
+	LockingContext LockingContext
 }
 
 type QueueRunner struct {
-	queues    map[string]*Queue
-	listeners []EndListener
-	logger    Logger
-	locking   LockingContext
-	mu        sync.Mutex
-	counter   uint64
+	queues     map[*Queue]struct{}
+	idle       chan struct{}
+	idleID     uint64
+	onIdle     []idleCallbackEntry
+	templates  map[string]*queueTemplate
+	scheduled  map[string]*scheduledStart
+	schedules  map[string]*cronEntry
+	clock      Clock
+	listeners  []endListenerEntry
+	listenerID uint64
+	dispatcher *listenerDispatcher
+	logger     Logger
+	locking    LockingContext
+	pool       *workerPool
+	middleware []Middleware
+	events     *eventBus
+	mu         sync.Mutex
+	counter    uint64
+	closed     bool
 }
 
 func NewQueueRunner(opts RunnerOpts) *QueueRunner {
 	runner := &QueueRunner{
-		queues:  map[string]*Queue{},
-		locking: NewLockManager(),
+		queues:     map[*Queue]struct{}{},
+		templates:  map[string]*queueTemplate{},
+		scheduled:  map[string]*scheduledStart{},
+		schedules:  map[string]*cronEntry{},
+		clock:      opts.Clock,
+		locking:    NewLockManager(),
+		middleware: append([]Middleware{}, opts.Middleware...),
+		events:     &eventBus{},
 	}
 
 	if opts.Logger != nil {
 		runner.logger = opts.Logger
 	}
+	if opts.Workers > 0 {
+		runner.pool = newWorkerPool(opts.Workers)
+	}
+	if runner.clock == nil {
+		runner.clock = realClock{}
+	}
+	if opts.LockingContext != nil {
+		runner.locking = opts.LockingContext
+	}
+	if opts.AsyncListeners {
+		runner.dispatcher = &listenerDispatcher{}
+	}
 
 	return runner
 }
@@ -40,43 +79,107 @@ func (runner *QueueRunner) PrepareLockingContext() LockingContext {
 	return runner.locking
 }
 
-func (runner *QueueRunner) Add(actions []Action, context map[string]any, name string) {
+func (runner *QueueRunner) Add(actions []Action, context map[string]any, name string) error {
+	queue, err := runner.prepare(actions, context, name, nil)
+	if err != nil {
+		return err
+	}
+
+	runner.run(queue, context)
+	return nil
+}
+
+func (runner *QueueRunner) prepare(actions []Action, context map[string]any, name string, template *queueTemplate) (*Queue, error) {
+	runner.mu.Lock()
+	closed := runner.closed
+	runner.mu.Unlock()
+	if closed {
+		return nil, ErrRunnerClosed
+	}
+
 	queueName := name
 	if queueName == "" {
 		queueName = runner.getName()
 	}
 
-	queue := NewQueue(QueueOpts{
+	opts := QueueOpts{
 		Name:           queueName,
 		Actions:        actions,
-		End:            func() { runner.onQueueEnd(queueName) },
 		Logger:         runner.logger,
 		LockingContext: runner.locking,
-	})
+		Middleware:     runner.middleware,
+	}
+	if template != nil {
+		opts.OnError = template.opts.OnError
+		opts.Limits = template.opts.Limits
+		opts.Middleware = append(append([]Middleware{}, runner.middleware...), template.opts.Middleware...)
+	}
 
-	runner.mu.Lock()
-	runner.queues[queueName] = queue
-	runner.mu.Unlock()
+	var queue *Queue
+	opts.End = func() { runner.onQueueEnd(queue) }
+	queue = NewQueue(opts)
 
-	go queue.Run(context)
+	if err := queue.Validate(context); err != nil {
+		return nil, err
+	}
+	queue.runnerBus = runner.events
+	queue.template = template
+
+	return queue, nil
 }
 
-func (runner *QueueRunner) AddEndListener(listener EndListener) {
-	runner.listeners = append(runner.listeners, listener)
+func (runner *QueueRunner) run(queue *Queue, context map[string]any) {
+	runner.track(queue)
+
+	if runner.pool != nil {
+		runner.pool.run(queue, context)
+		return
+	}
+
+	go queue.Run(context)
 }
 
-func (runner *QueueRunner) onQueueEnd(name string) {
+// Close shuts the runner down: queues waiting in AddAt or AddAfter are
+// dropped, recurring schedules are stopped and new queues are refused with
+// ErrRunnerClosed. Queues already running go on to their end; the worker
+// pool's goroutines exit once nothing is left to run.
+func (runner *QueueRunner) Close() {
 	runner.mu.Lock()
-	delete(runner.queues, name)
-	size := len(runner.queues)
+	if runner.closed {
+		runner.mu.Unlock()
+		return
+	}
+	runner.closed = true
+	scheduled, schedules := runner.scheduled, runner.schedules
+	runner.scheduled = map[string]*scheduledStart{}
+	runner.schedules = map[string]*cronEntry{}
 	runner.mu.Unlock()
 
-	for _, listener := range runner.listeners {
-		listener(name, size)
+	for _, start := range scheduled {
+		if start.timer != nil {
+			start.timer.Stop()
+		}
 	}
+	for _, entry := range schedules {
+		entry.stop()
+	}
+}
+
+func (runner *QueueRunner) Subscribe(buffer int) *Subscription {
+	return runner.events.subscribe(buffer)
+}
+
+func (runner *QueueRunner) log() Logger {
+	if runner.logger == nil {
+		return defaultLogger()
+	}
+	return runner.logger
 }
 
 func (runner *QueueRunner) getName() string {
-	id := atomic.AddUint64(&runner.counter, 1)
-	return fmt.Sprintf("queue-%d", id)
+	return fmt.Sprintf("queue-%d", runner.nextID())
+}
+
+func (runner *QueueRunner) nextID() uint64 {
+	return atomic.AddUint64(&runner.counter, 1)
 }
@@ -0,0 +1,96 @@
+package queuerunner
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+type ScheduledSnapshot struct {
+	ID    string
+	Queue string
+	At    time.Time
+}
+
+type scheduledStart struct {
+	id      string
+	queue   *Queue
+	context map[string]any
+	at      time.Time
+	timer   Timer
+}
+
+func (runner *QueueRunner) AddAfter(delay time.Duration, actions []Action, context map[string]any, name string) (string, error) {
+	return runner.AddAt(runner.clock.Now().Add(delay), actions, context, name)
+}
+
+// AddAt validates the queue right away and starts it at the given time. It
+// returns an id that can be passed to CancelScheduled.
+func (runner *QueueRunner) AddAt(at time.Time, actions []Action, context map[string]any, name string) (string, error) {
+	queue, err := runner.prepare(actions, context, name, nil)
+	if err != nil {
+		return "", err
+	}
+
+	scheduled := &scheduledStart{
+		id:      fmt.Sprintf("scheduled-%d", runner.nextID()),
+		queue:   queue,
+		context: context,
+		at:      at,
+	}
+
+	runner.mu.Lock()
+	runner.scheduled[scheduled.id] = scheduled
+	runner.mu.Unlock()
+
+	timer := runner.clock.AfterFunc(at.Sub(runner.clock.Now()), func() {
+		runner.fireScheduled(scheduled.id)
+	})
+
+	runner.mu.Lock()
+	_, pending := runner.scheduled[scheduled.id]
+	if pending {
+		scheduled.timer = timer
+	}
+	runner.mu.Unlock()
+
+	if !pending {
+		timer.Stop()
+	}
+	return scheduled.id, nil
+}
+
+func (runner *QueueRunner) CancelScheduled(id string) bool {
+	runner.mu.Lock()
+	scheduled, ok := runner.scheduled[id]
+	delete(runner.scheduled, id)
+	runner.mu.Unlock()
+
+	if ok && scheduled.timer != nil {
+		scheduled.timer.Stop()
+	}
+	return ok
+}
+
+func (runner *QueueRunner) fireScheduled(id string) {
+	runner.mu.Lock()
+	scheduled, ok := runner.scheduled[id]
+	delete(runner.scheduled, id)
+	runner.mu.Unlock()
+
+	if ok {
+		runner.run(scheduled.queue, scheduled.context)
+	}
+}
+
+func (runner *QueueRunner) scheduledSnapshot() []ScheduledSnapshot {
+	runner.mu.Lock()
+	snapshot := make([]ScheduledSnapshot, 0, len(runner.scheduled))
+	for _, scheduled := range runner.scheduled {
+		snapshot = append(snapshot, ScheduledSnapshot{ID: scheduled.id, Queue: scheduled.queue.name, At: scheduled.at})
+	}
+	runner.mu.Unlock()
+
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].At.Before(snapshot[j].At) })
+	return snapshot
+}
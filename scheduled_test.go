@@ -0,0 +1,78 @@
+package queuerunner
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAddAfterAndAddAtUseClock(t *testing.T) {
+	clock := newTestClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}, Clock: clock})
+	var ran int32
+	count := anyAction(func(_ *Context) error {
+		atomic.AddInt32(&ran, 1)
+		return nil
+	})
+
+	if _, err := runner.AddAfter(time.Minute, []Action{count}, map[string]any{}, "later"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runner.AddAt(clock.Now().Add(time.Hour), []Action{count}, map[string]any{}, "at"); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduled := runner.Inspect().Scheduled
+	if len(scheduled) != 2 || scheduled[0].Queue != "later" || scheduled[1].Queue != "at" {
+		t.Fatalf("unexpected scheduled queues: %+v", scheduled)
+	}
+
+	clock.Advance(time.Minute)
+	waitIdle(t, runner)
+	if atomic.LoadInt32(&ran) != 1 {
+		t.Fatalf("expected one queue to run, got %d", ran)
+	}
+
+	clock.Advance(time.Hour)
+	waitIdle(t, runner)
+	if atomic.LoadInt32(&ran) != 2 || len(runner.Inspect().Scheduled) != 0 {
+		t.Fatalf("expected both queues to run, got %d", ran)
+	}
+}
+
+func TestCancelScheduled(t *testing.T) {
+	clock := newTestClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}, Clock: clock})
+	var ran int32
+
+	id, err := runner.AddAfter(time.Second, []Action{anyAction(func(_ *Context) error {
+		atomic.AddInt32(&ran, 1)
+		return nil
+	})}, map[string]any{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !runner.CancelScheduled(id) {
+		t.Fatal("expected pending queue to be cancelled")
+	}
+	if runner.CancelScheduled(id) {
+		t.Fatal("expected second cancel to report nothing pending")
+	}
+
+	clock.Advance(time.Minute)
+	waitIdle(t, runner)
+	if atomic.LoadInt32(&ran) != 0 {
+		t.Fatal("cancelled queue ran")
+	}
+}
+
+func waitIdle(t *testing.T, runner *QueueRunner) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := runner.WaitIdle(ctx); err != nil {
+		t.Fatalf("runner did not become idle: %v", err)
+	}
+}
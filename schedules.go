@@ -0,0 +1,284 @@
+package queuerunner
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrScheduleNeverRuns = errors.New("cron expression never matches")
+
+type OverlapPolicy int
+
+const (
+	OverlapSkip OverlapPolicy = iota
+	OverlapQueue
+	OverlapAllow
+)
+
+type CatchUpPolicy int
+
+const (
+	CatchUpSkip CatchUpPolicy = iota
+	CatchUpOnce
+	CatchUpAll
+)
+
+const DefaultMissedAfter = time.Minute
+
+type ScheduleOpts struct {
+	Location    *time.Location
+	Overlap     OverlapPolicy
+	CatchUp     CatchUpPolicy
+	MissedAfter time.Duration
+}
+
+type ScheduleSnapshot struct {
+	ID       string
+	Spec     string
+	Template string
+	Next     time.Time
+	Running  int
+	Pending  int
+	Runs     uint64
+	Skipped  uint64
+}
+
+type cronEntry struct {
+	id       string
+	seq      uint64
+	spec     string
+	template string
+	data     map[string]any
+	schedule *CronSchedule
+	opts     ScheduleOpts
+	runner   *QueueRunner
+
+	mu      sync.Mutex
+	next    time.Time
+	last    time.Time
+	timer   Timer
+	stopped bool
+	running int
+	pending int
+	runs    uint64
+	skipped uint64
+}
+
+func (runner *QueueRunner) Schedule(spec string, template string, data map[string]any) (string, error) {
+	return runner.ScheduleWith(spec, template, data, ScheduleOpts{})
+}
+
+// ScheduleWith starts the template every time the cron expression matches
+// and returns an id for Unschedule. A run is missed when its timer fires more
+// than MissedAfter late, for example after the process was suspended;
+// CatchUp decides whether missed runs are dropped, collapsed into one run or
+// all started.
+func (runner *QueueRunner) ScheduleWith(spec string, template string, data map[string]any, opts ScheduleOpts) (string, error) {
+	schedule, err := ParseCron(spec)
+	if err != nil {
+		return "", err
+	}
+	if _, err := runner.template(template); err != nil {
+		return "", err
+	}
+	if opts.Location == nil {
+		opts.Location = time.Local
+	}
+	if opts.MissedAfter <= 0 {
+		opts.MissedAfter = DefaultMissedAfter
+	}
+
+	seq := runner.nextID()
+	entry := &cronEntry{
+		id:       fmt.Sprintf("schedule-%d", seq),
+		seq:      seq,
+		spec:     spec,
+		template: template,
+		data:     data,
+		schedule: schedule,
+		opts:     opts,
+		runner:   runner,
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	entry.next = schedule.Next(runner.clock.Now().In(opts.Location))
+	if entry.next.IsZero() {
+		return "", fmt.Errorf("%w: %q", ErrScheduleNeverRuns, spec)
+	}
+
+	runner.mu.Lock()
+	if runner.closed {
+		runner.mu.Unlock()
+		return "", ErrRunnerClosed
+	}
+	runner.schedules[entry.id] = entry
+	runner.mu.Unlock()
+
+	entry.arm()
+	return entry.id, nil
+}
+
+func (runner *QueueRunner) Unschedule(id string) bool {
+	runner.mu.Lock()
+	entry, ok := runner.schedules[id]
+	delete(runner.schedules, id)
+	runner.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	entry.stop()
+	return true
+}
+
+func (entry *cronEntry) stop() {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	entry.stopped = true
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+}
+
+func (entry *cronEntry) arm() {
+	clock := entry.runner.clock
+	entry.timer = clock.AfterFunc(entry.next.Sub(clock.Now()), entry.fire)
+}
+
+func (entry *cronEntry) fire() {
+	entry.mu.Lock()
+	if entry.stopped {
+		entry.mu.Unlock()
+		return
+	}
+
+	now := entry.runner.clock.Now().In(entry.opts.Location)
+	missed, onTime := 0, 0
+	for occurrence := entry.next; !occurrence.IsZero() && !occurrence.After(now); occurrence = entry.schedule.Next(occurrence) {
+		if now.Sub(occurrence) > entry.opts.MissedAfter {
+			missed++
+		} else {
+			onTime++
+		}
+		entry.last = occurrence
+	}
+
+	runs := onTime
+	switch entry.opts.CatchUp {
+	case CatchUpOnce:
+		if missed > 0 && runs == 0 {
+			runs = 1
+		}
+	case CatchUpAll:
+		runs += missed
+	}
+	entry.skipped += uint64(onTime + missed - runs)
+
+	entry.next = entry.following(now)
+	if !entry.next.IsZero() {
+		entry.arm()
+	}
+	entry.mu.Unlock()
+
+	for ; runs > 0; runs-- {
+		entry.trigger()
+	}
+}
+
+// following returns the first occurrence after now. For fixed-time
+// schedules it must also be later on the wall clock than the last one
+// handled: when the clocks go back, now may be earlier on the wall clock
+// than an occurrence that already fired.
+func (entry *cronEntry) following(now time.Time) time.Time {
+	next := entry.schedule.Next(now)
+	for !next.IsZero() && !entry.last.IsZero() && entry.schedule.repeated(next, wallClock(entry.last)) {
+		next = entry.schedule.Next(next)
+	}
+	return next
+}
+
+func (entry *cronEntry) trigger() {
+	entry.mu.Lock()
+	if entry.running > 0 {
+		switch entry.opts.Overlap {
+		case OverlapSkip:
+			entry.skipped++
+			entry.mu.Unlock()
+			return
+		case OverlapQueue:
+			entry.pending++
+			entry.mu.Unlock()
+			return
+		}
+	}
+	entry.running++
+	entry.runs++
+	entry.mu.Unlock()
+
+	entry.start()
+}
+
+func (entry *cronEntry) start() {
+	if err := entry.runner.startTemplate(entry.template, entry.data, entry.finished); err != nil {
+		logger := entry.runner.log()
+		logger.Info(fmt.Sprintf("QueueRunner: schedule %s failed to start %s", entry.id, entry.template))
+		logger.Error(err)
+		entry.finished()
+	}
+}
+
+func (entry *cronEntry) finished() {
+	entry.mu.Lock()
+	entry.running--
+	if entry.pending == 0 || entry.running > 0 {
+		entry.mu.Unlock()
+		return
+	}
+	entry.pending--
+	entry.running++
+	entry.runs++
+	entry.mu.Unlock()
+
+	entry.start()
+}
+
+func (entry *cronEntry) snapshot() ScheduleSnapshot {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	return ScheduleSnapshot{
+		ID:       entry.id,
+		Spec:     entry.spec,
+		Template: entry.template,
+		Next:     entry.next,
+		Running:  entry.running,
+		Pending:  entry.pending,
+		Runs:     entry.runs,
+		Skipped:  entry.skipped,
+	}
+}
+
+func (runner *QueueRunner) schedulesSnapshot() []ScheduleSnapshot {
+	runner.mu.Lock()
+	entries := make([]*cronEntry, 0, len(runner.schedules))
+	for _, entry := range runner.schedules {
+		entries = append(entries, entry)
+	}
+	runner.mu.Unlock()
+
+	// IDs carry a sequence number, which sorts wrongly as text once it
+	// reaches two digits.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	snapshot := make([]ScheduleSnapshot, 0, len(entries))
+	for _, entry := range entries {
+		snapshot = append(snapshot, entry.snapshot())
+	}
+	return snapshot
+}
@@ -0,0 +1,232 @@
+package queuerunner
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newScheduleRunner(t *testing.T, action Action) (*QueueRunner, *testClock) {
+	t.Helper()
+	return newScheduleRunnerAt(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), action)
+}
+
+func newScheduleRunnerAt(t *testing.T, start time.Time, action Action) (*QueueRunner, *testClock) {
+	t.Helper()
+	clock := newTestClock(start)
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}, Clock: clock})
+	if err := runner.Register("job", func() []Action { return []Action{action} }, TemplateOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	return runner, clock
+}
+
+func TestScheduleRunsTemplate(t *testing.T) {
+	var ran int32
+	runner, clock := newScheduleRunner(t, anyAction(func(_ *Context) error {
+		atomic.AddInt32(&ran, 1)
+		return nil
+	}))
+
+	if _, err := runner.Schedule("bad", "job", nil); !errors.Is(err, ErrInvalidCron) {
+		t.Fatalf("expected ErrInvalidCron, got %v", err)
+	}
+	if _, err := runner.Schedule("* * * * *", "missing", nil); !errors.Is(err, ErrUnknownTemplate) {
+		t.Fatalf("expected ErrUnknownTemplate, got %v", err)
+	}
+
+	id, err := runner.ScheduleWith("*/5 * * * *", "job", map[string]any{}, ScheduleOpts{Location: time.UTC})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schedules := runner.Inspect().Schedules
+	if len(schedules) != 1 || !schedules[0].Next.Equal(clock.Now().Add(5*time.Minute)) {
+		t.Fatalf("unexpected schedules: %+v", schedules)
+	}
+
+	for step := 0; step < 3; step++ {
+		clock.Advance(5 * time.Minute)
+		waitIdle(t, runner)
+	}
+	if atomic.LoadInt32(&ran) != 3 {
+		t.Fatalf("expected 3 runs, got %d", ran)
+	}
+
+	if !runner.Unschedule(id) || runner.Unschedule(id) {
+		t.Fatal("expected schedule to be removed exactly once")
+	}
+	clock.Advance(time.Hour)
+	waitIdle(t, runner)
+	if atomic.LoadInt32(&ran) != 3 || len(runner.Inspect().Schedules) != 0 {
+		t.Fatalf("unscheduled template ran, got %d runs", ran)
+	}
+}
+
+func TestScheduleOverlap(t *testing.T) {
+	for _, test := range []struct {
+		overlap OverlapPolicy
+		runs    int32
+		peak    int32
+	}{
+		{OverlapSkip, 1, 1},
+		{OverlapQueue, 3, 1},
+		{OverlapAllow, 3, 3},
+	} {
+		release := make(chan struct{})
+		var ran, running, peak int32
+		runner, clock := newScheduleRunner(t, anyAction(func(_ *Context) error {
+			atomic.AddInt32(&ran, 1)
+			current := atomic.AddInt32(&running, 1)
+			for {
+				seen := atomic.LoadInt32(&peak)
+				if current <= seen || atomic.CompareAndSwapInt32(&peak, seen, current) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt32(&running, -1)
+			return nil
+		}))
+
+		if _, err := runner.ScheduleWith("* * * * *", "job", nil, ScheduleOpts{Location: time.UTC, Overlap: test.overlap}); err != nil {
+			t.Fatal(err)
+		}
+		for step := 0; step < 3; step++ {
+			clock.Advance(time.Minute)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for atomic.LoadInt32(&running) < test.peak && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+		waitIdle(t, runner)
+
+		if got := atomic.LoadInt32(&ran); got != test.runs {
+			t.Fatalf("overlap %d: expected %d runs, got %d", test.overlap, test.runs, got)
+		}
+		if got := atomic.LoadInt32(&peak); got != test.peak {
+			t.Fatalf("overlap %d: expected at most %d concurrent runs, got %d", test.overlap, test.peak, got)
+		}
+	}
+}
+
+func TestScheduleCatchUp(t *testing.T) {
+	for _, test := range []struct {
+		catchUp CatchUpPolicy
+		runs    int32
+	}{
+		{CatchUpSkip, 0},
+		{CatchUpOnce, 1},
+		{CatchUpAll, 10},
+	} {
+		var ran int32
+		runner, clock := newScheduleRunner(t, anyAction(func(_ *Context) error {
+			atomic.AddInt32(&ran, 1)
+			return nil
+		}))
+
+		opts := ScheduleOpts{Location: time.UTC, Overlap: OverlapAllow, CatchUp: test.catchUp, MissedAfter: 10 * time.Second}
+		if _, err := runner.ScheduleWith("* * * * *", "job", nil, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		// Sleep through ten occurrences, then let the late timer fire.
+		clock.Jump(10*time.Minute + 30*time.Second)
+		clock.Advance(0)
+		waitIdle(t, runner)
+
+		if got := atomic.LoadInt32(&ran); got != test.runs {
+			t.Fatalf("catch-up %d: expected %d runs, got %d", test.catchUp, test.runs, got)
+		}
+		next := runner.Inspect().Schedules[0].Next
+		if expected := time.Date(2024, 1, 1, 0, 11, 0, 0, time.UTC); !next.Equal(expected) {
+			t.Fatalf("expected next run at %v, got %v", expected, next)
+		}
+	}
+}
+
+func TestScheduleFiresRepeatedHourOnce(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	var ran int32
+	runner, clock := newScheduleRunnerAt(t, time.Date(2024, 11, 3, 0, 0, 0, 0, location), anyAction(func(_ *Context) error {
+		atomic.AddInt32(&ran, 1)
+		return nil
+	}))
+
+	opts := ScheduleOpts{Location: location, MissedAfter: time.Hour}
+	if _, err := runner.ScheduleWith("30 1 * * *", "job", nil, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// The 01:30 EDT timer fires late, at 01:10 EST, before the wall clock
+	// reaches 01:30 a second time.
+	clock.Jump(2*time.Hour + 10*time.Minute)
+	clock.Advance(0)
+	waitIdle(t, runner)
+	clock.Advance(time.Hour)
+	waitIdle(t, runner)
+
+	if got := atomic.LoadInt32(&ran); got != 1 {
+		t.Fatalf("expected one run, got %d", got)
+	}
+	next := runner.Inspect().Schedules[0].Next
+	if expected := time.Date(2024, 11, 4, 1, 30, 0, 0, location); !next.Equal(expected) {
+		t.Fatalf("expected next run at %v, got %v", expected, next)
+	}
+}
+
+func TestScheduleKeepsIntervalsThroughRepeatedHour(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, test := range []struct {
+		spec string
+		runs int32
+	}{
+		// Four real hours from 00:30 EDT to 03:30 EST.
+		{"*/5 * * * *", 48},
+		{"0 * * * *", 4},
+	} {
+		var ran int32
+		runner, clock := newScheduleRunnerAt(t, time.Date(2024, 11, 3, 0, 30, 0, 0, location), anyAction(func(_ *Context) error {
+			atomic.AddInt32(&ran, 1)
+			return nil
+		}))
+		if _, err := runner.ScheduleWith(test.spec, "job", nil, ScheduleOpts{Location: location}); err != nil {
+			t.Fatal(err)
+		}
+
+		for step := 0; step < 48; step++ {
+			clock.Advance(5 * time.Minute)
+			waitIdle(t, runner)
+		}
+		if got := atomic.LoadInt32(&ran); got != test.runs {
+			t.Fatalf("%q: expected %d runs, got %d", test.spec, test.runs, got)
+		}
+	}
+}
+
+func TestSchedulesSnapshotKeepsCreationOrder(t *testing.T) {
+	runner, _ := newScheduleRunner(t, anyAction(func(_ *Context) error { return nil }))
+	ids := []string{}
+	for index := 0; index < 12; index++ {
+		id, err := runner.Schedule("0 0 * * *", "job", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	schedules := runner.Inspect().Schedules
+	for index, schedule := range schedules {
+		if schedule.ID != ids[index] {
+			t.Fatalf("expected %v in creation order, got %+v", ids, schedules)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package queuerunner
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrInvalidTemplate = errors.New("queue template needs a name and a factory")
+	ErrTemplateExists  = errors.New("queue template already registered")
+	ErrUnknownTemplate = errors.New("unknown queue template")
+)
+
+type TemplateOpts struct {
+	OnError       ErrorHandler
+	Middleware    []Middleware
+	Limits        Limits
+	MaxConcurrent int
+}
+
+type TemplateSnapshot struct {
+	Name          string
+	MaxConcurrent int
+	Running       int
+	Pending       int
+	Started       uint64
+	Completed     uint64
+	Failed        uint64
+}
+
+type QueueSnapshot struct {
+	Name     string
+	Template string
+}
+
+type RunnerSnapshot struct {
+	Queues    []QueueSnapshot
+	Templates []TemplateSnapshot
+	Scheduled []ScheduledSnapshot
+	Schedules []ScheduleSnapshot
+}
+
+type pendingStart struct {
+	queue   *Queue
+	context map[string]any
+}
+
+type queueTemplate struct {
+	name    string
+	factory func() []Action
+	opts    TemplateOpts
+
+	mu        sync.Mutex
+	running   int
+	pending   []pendingStart
+	started   uint64
+	completed uint64
+	failed    uint64
+}
+
+func (runner *QueueRunner) Register(name string, factory func() []Action, opts TemplateOpts) error {
+	if name == "" || factory == nil {
+		return ErrInvalidTemplate
+	}
+
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+
+	if _, ok := runner.templates[name]; ok {
+		return fmt.Errorf("%w: %q", ErrTemplateExists, name)
+	}
+	runner.templates[name] = &queueTemplate{name: name, factory: factory, opts: opts}
+	return nil
+}
+
+// Start builds a queue from the named template and runs it with data. When
+// the template already runs MaxConcurrent queues the new one waits for a
+// running one to end.
+func (runner *QueueRunner) Start(name string, data map[string]any) error {
+	return runner.startTemplate(name, data, nil)
+}
+
+// startTemplate starts a queue from the named template. done, when set, runs
+// once the queue ends, before the runner can report itself idle.
+func (runner *QueueRunner) startTemplate(name string, data map[string]any, done func()) error {
+	template, err := runner.template(name)
+	if err != nil {
+		return err
+	}
+
+	queue, err := runner.prepare(template.factory(), data, fmt.Sprintf("%s-%d", name, runner.nextID()), template)
+	if err != nil {
+		return err
+	}
+	queue.done = done
+
+	if template.admit(queue, data) {
+		runner.run(queue, data)
+	}
+	return nil
+}
+
+func (runner *QueueRunner) template(name string) (*queueTemplate, error) {
+	runner.mu.Lock()
+	template, ok := runner.templates[name]
+	runner.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownTemplate, name)
+	}
+	return template, nil
+}
+
+func (template *queueTemplate) admit(queue *Queue, context map[string]any) bool {
+	template.mu.Lock()
+	defer template.mu.Unlock()
+
+	if template.opts.MaxConcurrent > 0 && template.running >= template.opts.MaxConcurrent {
+		template.pending = append(template.pending, pendingStart{queue: queue, context: context})
+		return false
+	}
+
+	template.running++
+	template.started++
+	return true
+}
+
+// done records the end of queue and returns the next pending start, which
+// takes over the freed slot.
+func (template *queueTemplate) done(queue *Queue) *pendingStart {
+	template.mu.Lock()
+	defer template.mu.Unlock()
+
+	template.completed++
+	if queue.fatal != nil {
+		template.failed++
+	}
+
+	if len(template.pending) == 0 {
+		template.running--
+		return nil
+	}
+
+	next := template.pending[0]
+	template.pending[0] = pendingStart{}
+	template.pending = template.pending[1:]
+	template.started++
+	return &next
+}
+
+func (template *queueTemplate) snapshot() TemplateSnapshot {
+	template.mu.Lock()
+	defer template.mu.Unlock()
+
+	return TemplateSnapshot{
+		Name:          template.name,
+		MaxConcurrent: template.opts.MaxConcurrent,
+		Running:       template.running,
+		Pending:       len(template.pending),
+		Started:       template.started,
+		Completed:     template.completed,
+		Failed:        template.failed,
+	}
+}
+
+func (runner *QueueRunner) Inspect() RunnerSnapshot {
+	runner.mu.Lock()
+	queues := make([]*Queue, 0, len(runner.queues))
+	for queue := range runner.queues {
+		queues = append(queues, queue)
+	}
+	templates := make([]*queueTemplate, 0, len(runner.templates))
+	for _, template := range runner.templates {
+		templates = append(templates, template)
+	}
+	runner.mu.Unlock()
+
+	snapshot := RunnerSnapshot{}
+	for _, queue := range queues {
+		entry := QueueSnapshot{Name: queue.name}
+		if queue.template != nil {
+			entry.Template = queue.template.name
+		}
+		snapshot.Queues = append(snapshot.Queues, entry)
+	}
+	for _, template := range templates {
+		snapshot.Templates = append(snapshot.Templates, template.snapshot())
+	}
+
+	sort.Slice(snapshot.Queues, func(i, j int) bool { return snapshot.Queues[i].Name < snapshot.Queues[j].Name })
+	sort.Slice(snapshot.Templates, func(i, j int) bool { return snapshot.Templates[i].Name < snapshot.Templates[j].Name })
+	snapshot.Scheduled = runner.scheduledSnapshot()
+	snapshot.Schedules = runner.schedulesSnapshot()
+	return snapshot
+}
@@ -0,0 +1,154 @@
+package queuerunner
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTemplatesStartWithDefaults(t *testing.T) {
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}})
+	var mu sync.Mutex
+	seen := []string{}
+	handled := make(chan error, 1)
+
+	err := runner.Register("report", func() []Action {
+		return []Action{
+			Named("collect", func(ctx *Context) error {
+				mu.Lock()
+				seen = append(seen, ctx.Data["user"].(string))
+				mu.Unlock()
+				return nil
+			}),
+			Named("fail", func(_ *Context) error { return ErrInvalidScope }),
+		}
+	}, TemplateOpts{
+		OnError: func(err error, ctx *Context) {
+			handled <- err
+			ctx.Abort()
+		},
+		Middleware: []Middleware{func(next Action) Action {
+			return func(ctx *Context) error {
+				ctx.Set("traced", true)
+				return next(ctx)
+			}
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected register error: %v", err)
+	}
+	if err := runner.Register("report", func() []Action { return nil }, TemplateOpts{}); !errors.Is(err, ErrTemplateExists) {
+		t.Fatalf("expected ErrTemplateExists, got %v", err)
+	}
+	if err := runner.Start("missing", nil); !errors.Is(err, ErrUnknownTemplate) {
+		t.Fatalf("expected ErrUnknownTemplate, got %v", err)
+	}
+
+	if err := runner.Start("report", map[string]any{"user": "alice"}); err != nil {
+		t.Fatalf("unexpected start error: %v", err)
+	}
+
+	select {
+	case err := <-handled:
+		if !errors.Is(err, ErrInvalidScope) {
+			t.Fatalf("unexpected handled error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("template error handler was not used")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := runner.WaitIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := runner.Inspect()
+	if len(snapshot.Templates) != 1 {
+		t.Fatalf("unexpected snapshot: %+v", snapshot)
+	}
+	stats := snapshot.Templates[0]
+	if stats.Started != 1 || stats.Completed != 1 || stats.Failed != 1 || stats.Running != 0 {
+		t.Fatalf("unexpected template stats: %+v", stats)
+	}
+	if len(seen) != 1 || seen[0] != "alice" {
+		t.Fatalf("unexpected seen: %v", seen)
+	}
+}
+
+func TestTemplateConcurrencyCap(t *testing.T) {
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}})
+	var active, peak int32
+	release := make(chan struct{})
+
+	runner.Register("browser", func() []Action {
+		return []Action{anyAction(func(_ *Context) error {
+			current := atomic.AddInt32(&active, 1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if current <= old || atomic.CompareAndSwapInt32(&peak, old, current) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt32(&active, -1)
+			return nil
+		})}
+	}, TemplateOpts{MaxConcurrent: 2})
+
+	for index := 0; index < 5; index++ {
+		if err := runner.Start("browser", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	snapshot := runner.Inspect()
+	if len(snapshot.Queues) != 2 || snapshot.Queues[0].Template != "browser" {
+		t.Fatalf("expected two running template queues, got %+v", snapshot.Queues)
+	}
+	if stats := snapshot.Templates[0]; stats.Running != 2 || stats.Pending != 3 {
+		t.Fatalf("unexpected template stats: %+v", stats)
+	}
+
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := runner.WaitIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&peak) != 2 {
+		t.Fatalf("expected at most 2 concurrent queues, got %d", peak)
+	}
+	if stats := runner.Inspect().Templates[0]; stats.Completed != 5 || stats.Pending != 0 {
+		t.Fatalf("unexpected template stats: %+v", stats)
+	}
+}
+
+func TestTemplateRecoveredErrorIsNotAFailure(t *testing.T) {
+	runner := NewQueueRunner(RunnerOpts{Logger: &testLogger{}})
+	err := runner.Register("sync", func() []Action {
+		return []Action{func(_ *Context) error { return ErrInvalidScope }}
+	}, TemplateOpts{OnError: func(_ error, _ *Context) {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Start("sync", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := runner.WaitIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := runner.Inspect().Templates[0]
+	if stats.Completed != 1 || stats.Failed != 0 {
+		t.Fatalf("expected a completed run without failure, got %+v", stats)
+	}
+}
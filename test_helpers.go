@@ -1,11 +1,16 @@
 package queuerunner
 
-import "sync"
+import (
+	"sort"
+	"sync"
+	"time"
+)
 
 type testLogger struct {
-	mu     sync.Mutex
-	infos  []string
-	errors []error
+	mu       sync.Mutex
+	infos    []string
+	errors   []error
+	contexts []string
 }
 
 func (logger *testLogger) Info(message string) {
@@ -14,7 +19,11 @@ func (logger *testLogger) Info(message string) {
 	logger.infos = append(logger.infos, message)
 }
 
-func (logger *testLogger) SetContext(_ string) {}
+func (logger *testLogger) SetContext(context string) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.contexts = append(logger.contexts, context)
+}
 
 func (logger *testLogger) Error(err error) {
 	logger.mu.Lock()
@@ -27,3 +36,86 @@ func (logger *testLogger) ErrorCount() int {
 	defer logger.mu.Unlock()
 	return len(logger.errors)
 }
+
+func (logger *testLogger) Contexts() []string {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	return append([]string{}, logger.contexts...)
+}
+
+type testClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*testTimer
+}
+
+type testTimer struct {
+	clock *testClock
+	at    time.Time
+	fn    func()
+	done  bool
+}
+
+func newTestClock(now time.Time) *testClock {
+	return &testClock{now: now}
+}
+
+func (clock *testClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+func (clock *testClock) AfterFunc(delay time.Duration, fn func()) Timer {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	timer := &testTimer{clock: clock, at: clock.now.Add(delay), fn: fn}
+	clock.timers = append(clock.timers, timer)
+	return timer
+}
+
+func (clock *testClock) Advance(delay time.Duration) {
+	clock.mu.Lock()
+	target := clock.now.Add(delay)
+	clock.mu.Unlock()
+
+	for {
+		clock.mu.Lock()
+		sort.SliceStable(clock.timers, func(i, j int) bool { return clock.timers[i].at.Before(clock.timers[j].at) })
+		var due *testTimer
+		for _, timer := range clock.timers {
+			if !timer.done && !timer.at.After(target) {
+				due = timer
+				break
+			}
+		}
+		if due == nil {
+			clock.now = target
+			clock.mu.Unlock()
+			return
+		}
+		due.done = true
+		if due.at.After(clock.now) {
+			clock.now = due.at
+		}
+		clock.mu.Unlock()
+
+		due.fn()
+	}
+}
+
+// Jump moves the clock forward without firing timers, like a process that
+// was suspended and resumes late.
+func (clock *testClock) Jump(delay time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.now = clock.now.Add(delay)
+}
+
+func (timer *testTimer) Stop() bool {
+	timer.clock.mu.Lock()
+	defer timer.clock.mu.Unlock()
+	stopped := !timer.done
+	timer.done = true
+	return stopped
+}
@@ -4,6 +4,8 @@ type Action func(*Context) error
 
 type ErrorHandler func(err error, ctx *Context)
 
+type Middleware func(next Action) Action
+
 type Branches struct {
 	Then []Action
 	Else []Action
@@ -1,6 +1,9 @@
 package queuerunner
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 type Condition func(ctx *Context) (bool, error)
 
@@ -11,25 +14,23 @@ type utilHelper struct {
 }
 
 var Util = utilHelper{
-	Abort: func(ctx *Context) error {
+	Abort: wrapAction(nil, func(ctx *Context) error {
 		if ctx != nil {
 			ctx.Abort()
 		}
 		return nil
-	},
+	}, nameAction("Util.Abort")),
 }
 
 func (utilHelper) Delay(timeout time.Duration) Action {
-	return func(_ *Context) error {
-		if timeout > 0 {
-			time.Sleep(timeout)
-		}
+	return wrapAction(nil, func(ctx *Context) error {
+		ctx.sleep(timeout)
 		return nil
-	}
+	}, nameAction(fmt.Sprintf("Util.Delay(%v)", timeout)))
 }
 
 func (utilHelper) If(condition Condition, branches Branches) Action {
-	return func(ctx *Context) error {
+	return wrapAction(nil, func(ctx *Context) error {
 		result, err := condition(ctx)
 		if err != nil {
 			return err
@@ -42,11 +43,14 @@ func (utilHelper) If(condition Condition, branches Branches) Action {
 		}
 
 		return nil
-	}
+	}, func(info *actionInfo) {
+		info.meta.Name = "Util.If"
+		info.branches = [][]Action{branches.Then, branches.Else}
+	})
 }
 
 func (utilHelper) Valid(validator Validator, actions []Action) Action {
-	return func(ctx *Context) error {
+	return wrapAction(nil, func(ctx *Context) error {
 		result, err := validator(ctx)
 		if err != nil {
 			return err
@@ -57,5 +61,32 @@ func (utilHelper) Valid(validator Validator, actions []Action) Action {
 		}
 
 		return nil
+	}, func(info *actionInfo) {
+		info.meta.Name = "Util.Valid"
+		info.branches = [][]Action{actions, nil}
+	})
+}
+
+// Locked holds scope from before the first of the actions until after the
+// last one. If the queue stops in between, the scope is released when it
+// ends.
+func (utilHelper) Locked(scope string, actions []Action) Action {
+	if err := ValidateScope(scope); err != nil {
+		return func(_ *Context) error { return err }
 	}
+
+	release := wrapAction(nil, func(ctx *Context) error {
+		return ctx.ReleaseLock(scope)
+	}, nameAction(fmt.Sprintf("Util.Unlock(%s)", scope)))
+
+	return wrapAction(nil, func(ctx *Context) error {
+		if err := ctx.AcquireLock(scope); err != nil {
+			return err
+		}
+		ctx.Push(append(append([]Action{}, actions...), release))
+		return nil
+	}, func(info *actionInfo) {
+		info.meta.Name = fmt.Sprintf("Util.Locked(%s)", scope)
+		info.branches = [][]Action{actions}
+	})
 }